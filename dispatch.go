@@ -0,0 +1,216 @@
+package monkey
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// dispatchSlots is a maximum count of dispatched replacements.
+const dispatchSlots = 256
+
+// dispatchTable contains function values called instead of originals by "indirect trampolines".
+// Trampolines made in parent process and contain fixed address of table slot, function values placed to slots
+// in patched executable at registration time. Interface used as slot type because for function values its data word
+// is a pointer to function value so it can be used to make call like go calls closures.
+var dispatchTable [dispatchSlots]any
+
+// dispatchMu protects dispatchTable from concurrent modification by different patchers.
+var dispatchMu sync.Mutex
+
+// dispatchedReplacement is a replacement called via dispatch table.
+type dispatchedReplacement struct {
+	value reflect.Value
+	name  string // function name if replacement present in executable, empty for synthesized replacements
+	label string // describes synthesized replacement in manifest instead of name of function made by reflect
+	hook  bool   // original function called via gate while replacement is not set, see Inject and Return
+}
+
+// replacementName returns name of replacement listed in manifest.
+func (r dispatchedReplacement) replacementName() string {
+	if r.label != "" {
+		return r.label
+	}
+
+	name, _ := funcName(r.value)
+	return name
+}
+
+// dispatchSupported reports whether dispatched replacements supported on current architecture.
+func dispatchSupported() bool { return replacer.SupportsIndirect(runtime.GOARCH) }
+
+// isClosure reports whether function with provided name is a function literal or method value,
+// such functions may capture variables, so they must be called via dispatch table.
+func isClosure(name string) bool {
+	name = trimTypeArgs(name)
+
+	if strings.HasSuffix(name, "-fm") {
+		return true
+	}
+
+	idx := strings.LastIndex(name, ".func")
+	if idx < 0 || idx+len(".func") == len(name) {
+		return false
+	}
+
+	for _, c := range name[idx+len(".func"):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// trimTypeArgs removes type arguments (i.e. "[...]" or "[go.shape.int]") from the end of function name,
+// some go versions place them after name of function literal inside generic function.
+func trimTypeArgs(name string) string {
+	if !strings.HasSuffix(name, "]") {
+		return name
+	}
+
+	depth := 0
+	for i := len(name) - 1; i >= 0; i-- {
+		switch name[i] {
+		case ']':
+			depth++
+		case '[':
+			depth--
+			if depth == 0 {
+				return name[:i]
+			}
+		}
+	}
+
+	return name
+}
+
+// dispatchSlotAddrs returns runtime address of dispatch table and address of function value inside slot.
+func dispatchSlotAddrs() (table, slotSize, funcValueOffset uint64) {
+	slotSize = uint64(reflect.TypeOf(&dispatchTable).Elem().Elem().Size())
+
+	// interface consists of type and data words
+	return uint64(reflect.ValueOf(&dispatchTable).Pointer()), slotSize, slotSize / 2
+}
+
+// assignSlots assigns dispatch table slots to dispatched replacements.
+func (p *Patcher) assignSlots() (map[string]int, error) {
+	if len(p.dispatched) > dispatchSlots {
+		return nil, fmt.Errorf("%w: %d dispatched replacements, maximum is %d",
+			ErrTooManyReplacements, len(p.dispatched), dispatchSlots)
+	}
+
+	originals := make([]string, 0, len(p.dispatched))
+	for original := range p.dispatched {
+		originals = append(originals, original)
+	}
+
+	sort.Strings(originals)
+
+	slots := make(map[string]int, len(originals))
+	for i, original := range originals {
+		slots[original] = i
+	}
+
+	return slots, nil
+}
+
+// makeDispatchedReplacements puts indirect trampolines to originals. Dispatch table may be used only for current
+// executable because addresses of its slots calculated using current process memory layout. Closures can't be called
+// directly without captured variables, so ErrCapturingClosure returned for other executables.
+// Gates calling originals of hooked replacements returned relative to anchor function, see hookedOriginal.
+func (p *Patcher) makeDispatchedReplacements(r *replacer.Replacer, slots map[string]int) (map[string]int64, error) {
+	if len(p.dispatched) == 0 {
+		return nil, nil
+	}
+
+	if slots == nil {
+		for original, replacement := range p.dispatched {
+			if replacement.name == "" {
+				return nil, fmt.Errorf("%s: %w", original, ErrCurrentExecutableOnly)
+			}
+
+			return nil, fmt.Errorf("%s: %w", original, ErrCapturingClosure)
+		}
+
+		return nil, nil
+	}
+
+	// executable may be loaded at address other than specified in file (i.e. PIE),
+	// so find difference using some known function
+	anchor := reflect.ValueOf(NewPatcher).Pointer()
+
+	anchorEntry, err := r.Entry(runtime.FuncForPC(anchor).Name())
+	if err != nil {
+		return nil, err
+	}
+
+	pads, err := p.assignPads(r)
+	if err != nil {
+		return nil, err
+	}
+
+	table, slotSize, funcValueOffset := dispatchSlotAddrs()
+	table -= uint64(anchor) - anchorEntry
+
+	gates := make(map[string]int64, len(pads))
+	for original, replacement := range p.dispatched {
+		funcValueAddr := table + uint64(slots[original])*slotSize + funcValueOffset
+
+		if replacement.hook {
+			gate, err := r.Hook(original, funcValueAddr, pads[original])
+			if err != nil {
+				return nil, err
+			}
+
+			gates[original] = int64(gate - anchorEntry)
+			continue
+		}
+
+		// replacement called directly until it's placed to dispatch table
+		err = r.ReplaceIndirect(original, funcValueAddr, replacement.name)
+		if errors.Is(err, ErrShortFunction) {
+			// no room for indirect trampoline, direct call doesn't pass captured variables
+			return nil, fmt.Errorf("%s: %w: %w", original, ErrCapturingClosure, err)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return gates, nil
+}
+
+// registerDispatched registers replacement called via dispatch table.
+// Function value placed to dispatch table if we are running patched executable
+// and this replacement was applied to it, so patchers whose replacements were not applied don't overwrite slots.
+func (p *Patcher) registerDispatched(original string, replacement dispatchedReplacement, reg registration) {
+	p.register(original, reg, func() {
+		p.dispatched[original] = replacement
+
+		if applied == nil {
+			return
+		}
+
+		slot, ok := applied.Slots[original]
+		if !ok {
+			return
+		}
+
+		if !applied.applies(p.replacement(original, replacement.replacementName())) {
+			return
+		}
+
+		dispatchMu.Lock()
+		defer dispatchMu.Unlock()
+
+		dispatchTable[slot] = replacement.value.Interface()
+	})
+}
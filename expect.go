@@ -0,0 +1,407 @@
+package monkey
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// TestingT is a part of testing.TB used to verify expectations.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Cleanup(func())
+}
+
+// Expectation describes expected calls of function replaced by mock. See Expect.
+type Expectation[T any] struct {
+	p *Patcher
+	m *mock
+	e *expectation
+}
+
+// expectation is a type-erased part of Expectation.
+type expectation struct {
+	owner   TestingT // test which made expectation
+	site    string   // place in code where expectation was made
+	args    []any    // nil matches any arguments
+	results []reflect.Value
+	action  reflect.Value // function called to make results if set
+	times   int           // negative means any count of calls
+	calls   int
+	err     error // invalid results
+}
+
+// mock is a replacement of function which makes results according to expectations.
+type mock struct {
+	name       string
+	funcType   reflect.Type
+	mu         sync.Mutex
+	expected   []*expectation
+	unexpected []unexpectedCall
+}
+
+// unexpectedCall describes call of mock not matching expectations.
+type unexpectedCall struct {
+	description string
+	owners      []TestingT // tests which had expectations on mock at moment of call, empty means any test
+}
+
+// ownedBy reports whether unexpected call must be reported to test.
+func (c unexpectedCall) ownedBy(t TestingT) bool {
+	return len(c.owners) == 0 || slices.Contains(c.owners, t)
+}
+
+// Mock registers replacement of original function by mock (only once for each function in patcher).
+// Mock must be registered before patching, so it's usually done in init or TestMain, while expectations
+// are made by Expect in tests. Calls of mock not matching expectations return zero values and reported
+// by verification made by Expect.
+// Replacement synthesized at runtime, so it's called via dispatch table.
+// This works only on architectures supporting dispatch table (currently amd64, 386 and arm64,
+// ErrUnsupportedArchitecture reported otherwise) and only for current executable.
+//
+// Note that argument must be function despite "any" used as constraint. See RegisterReplacement for details.
+func Mock[T any](p *Patcher, original T, opts ...RegisterOption) {
+	p.mock(original, registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	})
+}
+
+// Expect adds expectation of call to mock of original function. Mock registered if it wasn't done by Mock before.
+// Expectation matches any arguments, returns zero values and must be met once unless configured otherwise:
+//
+//	monkey.Expect(t, patcher, http.Get).With("https://example.com").Return(resp, nil).Times(2)
+//
+// Expectations made by t are checked when test finishes: unmet expectations and unexpected calls
+// (with stack of caller) are reported to t, after this they are removed, so each test makes own expectations.
+// Unexpected call is reported to tests having expectations on the mock at moment of call
+// (or to any test if there were no expectations), so parallel tests may mock different functions.
+// Restrictions of Mock applied.
+//
+// Arguments passed to With and values passed to Return are checked against original function when they are set,
+// mismatches are reported on patching and when test finishes. Function passed to Do is checked by compiler.
+//
+// Note that argument must be function despite "any" used as constraint. See RegisterReplacement for details.
+func Expect[T any](t TestingT, p *Patcher, original T, opts ...RegisterOption) *Expectation[T] {
+	t.Helper()
+
+	reg := registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}
+
+	e := &expectation{owner: t, site: reg.site, times: 1}
+
+	m := p.mock(original, reg)
+	if m == nil {
+		// error reported on patching, type of function is unknown, so expectation is not checked
+		return &Expectation[T]{p: p, m: &mock{}, e: e}
+	}
+
+	m.mu.Lock()
+	m.expected = append(m.expected, e)
+	m.mu.Unlock()
+
+	p.verifyOnCleanup(t)
+
+	return &Expectation[T]{p: p, m: m, e: e}
+}
+
+// mock returns mock of original function registering it if needed. It returns nil if original is not a function
+// or mocks are not supported.
+func (p *Patcher) mock(original any, reg registration) *mock {
+	originalValue := reflect.ValueOf(original)
+	if originalValue.Kind() != reflect.Func {
+		p.fail(ErrFunctionNotFound)
+		return nil
+	}
+
+	originalName, ok := funcName(originalValue)
+	if !ok {
+		p.fail(ErrFunctionNotFound)
+		return nil
+	}
+
+	if !dispatchSupported() {
+		p.fail(fmt.Errorf("%s: %w", originalName, ErrUnsupportedArchitecture))
+		return nil
+	}
+
+	p.mu.Lock()
+	m, ok := p.mocks[originalName]
+	if !ok {
+		m = &mock{name: originalName, funcType: originalValue.Type()}
+		p.mocks[originalName] = m
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		p.registerDispatched(originalName, dispatchedReplacement{
+			value: reflect.MakeFunc(m.funcType, m.call),
+		}, reg)
+	}
+
+	return m
+}
+
+// With sets arguments of expected call. Arguments must match original function parameters: be assignable to them
+// or be nil for nilable types, they compared with arguments of call using reflect.DeepEqual.
+// For methods receiver is the first argument, variadic arguments passed as slice.
+// Invalid arguments reported on patching and when test finishes.
+func (x *Expectation[T]) With(args ...any) *Expectation[T] {
+	if x.m.funcType == nil {
+		return x
+	}
+
+	values, err := makeValues(x.m.funcType.In, x.m.funcType.NumIn(), args)
+	if err != nil {
+		err = fmt.Errorf("%s: %w: %w", x.m.name, ErrArgumentsMismatch, err)
+		x.p.fail(err)
+	}
+
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+
+	x.e.args = append([]any{}, args...)
+	if err == nil {
+		x.e.args = interfaces(values)
+	}
+
+	x.e.err = errors.Join(x.e.err, err)
+
+	return x
+}
+
+// Return sets values returned by expected call. Values must match original function results,
+// see Return for details. Invalid values reported on patching and when test finishes.
+func (x *Expectation[T]) Return(results ...any) *Expectation[T] {
+	if x.m.funcType == nil {
+		return x
+	}
+
+	values, err := makeResults(x.m.funcType, results)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", x.m.name, err)
+		x.p.fail(err)
+	}
+
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+
+	x.e.results, x.e.action, x.e.err = values, reflect.Value{}, errors.Join(x.e.err, err)
+
+	return x
+}
+
+// Do sets function called to make results of expected call. It receives arguments of call.
+func (x *Expectation[T]) Do(action T) *Expectation[T] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+
+	x.e.results, x.e.action = nil, reflect.ValueOf(action)
+
+	return x
+}
+
+// Times sets count of expected calls.
+func (x *Expectation[T]) Times(n int) *Expectation[T] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+
+	x.e.times = max(n, 0)
+
+	return x
+}
+
+// AnyTimes allows any count of expected calls including zero.
+func (x *Expectation[T]) AnyTimes() *Expectation[T] {
+	x.m.mu.Lock()
+	defer x.m.mu.Unlock()
+
+	x.e.times = -1
+
+	return x
+}
+
+// verifyOnCleanup checks when test finishes that expectations made by t on patcher were met
+// and there were no unexpected calls reported to t. Check registered once for each test.
+func (p *Patcher) verifyOnCleanup(t TestingT) {
+	t.Helper()
+
+	p.mu.Lock()
+	_, ok := p.verifying[t]
+	p.verifying[t] = struct{}{}
+	p.mu.Unlock()
+
+	if ok {
+		return
+	}
+
+	t.Cleanup(func() {
+		t.Helper()
+
+		p.mu.Lock()
+		delete(p.verifying, t)
+		mocks := make([]*mock, 0, len(p.mocks))
+		for _, m := range p.mocks {
+			mocks = append(mocks, m)
+		}
+		p.mu.Unlock()
+
+		for _, m := range mocks {
+			for _, problem := range m.verify(t) {
+				t.Errorf("%s", problem)
+			}
+		}
+	})
+}
+
+// call makes results of mocked function call. It's a body of replacement.
+func (m *mock) call(args []reflect.Value) []reflect.Value {
+	callArgs := interfaces(args)
+
+	m.mu.Lock()
+	e := m.match(callArgs)
+	if e == nil {
+		m.unexpected = append(m.unexpected, unexpectedCall{
+			description: fmt.Sprintf("unexpected call of %s%s at:\n%s", m.name, formatArgs(callArgs), callerStack()),
+			owners:      m.owners(),
+		})
+	} else {
+		e.calls++
+	}
+	m.mu.Unlock()
+
+	switch {
+	case e == nil || e.err != nil:
+		return zeroResults(m.funcType)
+	case e.action.IsValid():
+		if m.funcType.IsVariadic() {
+			return e.action.CallSlice(args)
+		}
+
+		return e.action.Call(args)
+	case e.results != nil:
+		return e.results
+	default:
+		return zeroResults(m.funcType)
+	}
+}
+
+// match returns first expectation matching arguments which may be met by call. Must be called with mutex held.
+func (m *mock) match(args []any) *expectation {
+	for _, e := range m.expected {
+		if e.times >= 0 && e.calls >= e.times {
+			continue
+		}
+
+		if e.args == nil || reflect.DeepEqual(e.args, args) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// owners returns tests having expectations on mock. Must be called with mutex held.
+func (m *mock) owners() []TestingT {
+	var owners []TestingT
+	for _, e := range m.expected {
+		if !slices.Contains(owners, e.owner) {
+			owners = append(owners, e.owner)
+		}
+	}
+
+	return owners
+}
+
+// verify returns descriptions of unmet expectations made by t and unexpected calls reported to t
+// and removes them from mock.
+func (m *mock) verify(t TestingT) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var problems []string
+
+	unexpected := m.unexpected[:0]
+	for _, call := range m.unexpected {
+		if !call.ownedBy(t) {
+			unexpected = append(unexpected, call)
+			continue
+		}
+
+		problems = append(problems, call.description)
+
+		// call is kept until it's reported to all owners
+		call.owners = slices.DeleteFunc(call.owners, func(owner TestingT) bool { return owner == t })
+		if len(call.owners) > 0 {
+			unexpected = append(unexpected, call)
+		}
+	}
+
+	expected := m.expected[:0]
+	for _, e := range m.expected {
+		if e.owner != t {
+			expected = append(expected, e)
+			continue
+		}
+
+		switch {
+		case e.err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %s", e.site, e.err))
+		case e.times >= 0 && e.calls != e.times:
+			problems = append(problems, fmt.Sprintf("%s: expected %d calls of %s%s, got %d",
+				e.site, e.times, m.name, formatArgs(e.args), e.calls))
+		}
+	}
+
+	if len(problems) > 0 && !mockApplied(m.name) {
+		problems = append(problems, fmt.Sprintf("%s: %s (mock it before patching)", m.name, ErrReplacementsNotApplied))
+	}
+
+	m.expected, m.unexpected = expected, unexpected
+
+	return problems
+}
+
+func formatArgs(args []any) string {
+	if args == nil {
+		return "(any arguments)"
+	}
+
+	return fmt.Sprint(args)
+}
+
+// mockApplied reports whether mock of function was placed to dispatch table of current executable.
+func mockApplied(name string) bool {
+	if applied == nil {
+		return false
+	}
+
+	_, ok := applied.Slots[name]
+
+	return ok
+}
+
+// callerStack returns stack of code which called replaced function. Frames of replacement are skipped.
+func callerStack() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	var sb strings.Builder
+	for {
+		frame, more := frames.Next()
+		if !isReplacementFrame(frame) {
+			fmt.Fprintf(&sb, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+
+		if !more {
+			return sb.String()
+		}
+	}
+}
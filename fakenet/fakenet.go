@@ -0,0 +1,80 @@
+// Package fakenet provides replacements of net.Dial, net.DialTimeout, (*net.Dialer).DialContext and net.LookupHost
+// routing connections to local stand-ins (i.e. httptest servers or in-process net.Pipe connections).
+// It allows to make tests of clients with hard-coded endpoints hermetic.
+//
+// Routes are consulted only in patched executable: Register before PatchAndExec of the Patcher, then every dial
+// in process (including ones made by net/http) goes through Network and fails with ErrNoRoute
+// for addresses without route, so test can't reach real network by accident. Listening is not affected,
+// stand-ins listening on loopback are dialed directly.
+package fakenet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xakep666/monkey"
+)
+
+// ErrNoRoute returned on attempt to dial address without route.
+var ErrNoRoute = errors.New("no route to address")
+
+var (
+	// network without routes, so dials made before Register fail too
+	defaultNetwork = NewNetwork()
+	currentNetwork atomic.Pointer[Network]
+)
+
+// Register registers replacements of net.Dial, net.DialTimeout, (*net.Dialer).DialContext, net.LookupHost and
+// (*net.Resolver).LookupHost in patcher. Replacements use provided network, dial deadlines and cancellation
+// are honored. Options are passed to each registration.
+func Register(p *monkey.Patcher, network *Network, opts ...monkey.RegisterOption) {
+	currentNetwork.Store(network)
+
+	monkey.RegisterReplacement(p, net.Dial, dial, opts...)
+	monkey.RegisterReplacement(p, net.DialTimeout, dialTimeout, opts...)
+	monkey.RegisterReplacement(p, (*net.Dialer).DialContext, dialContext, opts...)
+	monkey.RegisterReplacement(p, net.LookupHost, lookupHost, opts...)
+	// net.LookupHost is inlined, so replace method called by it
+	monkey.RegisterReplacement(p, (*net.Resolver).LookupHost, resolverLookupHost, opts...)
+}
+
+func current() *Network {
+	if n := currentNetwork.Load(); n != nil {
+		return n
+	}
+
+	return defaultNetwork
+}
+
+func dial(network, address string) (net.Conn, error) {
+	return dialContext(&net.Dialer{}, context.Background(), network, address)
+}
+
+func dialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return dialContext(&net.Dialer{Timeout: timeout}, context.Background(), network, address)
+}
+
+func dialContext(d *net.Dialer, ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	if !d.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.Deadline)
+		defer cancel()
+	}
+
+	return current().dial(ctx, network, address)
+}
+
+func lookupHost(host string) ([]string, error) { return current().lookupHost(host) }
+
+func resolverLookupHost(_ *net.Resolver, _ context.Context, host string) ([]string, error) {
+	return current().lookupHost(host)
+}
@@ -0,0 +1,75 @@
+//go:build integration
+
+package fakenet_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey"
+	"github.com/xakep666/monkey/fakenet"
+)
+
+var network = fakenet.NewNetwork()
+
+func init() {
+	fakenet.Register(monkey.Default(), network)
+}
+
+func TestMain(m *testing.M) {
+	monkey.MustPatchAndExec()
+	os.Exit(m.Run())
+}
+
+func TestFakeNet_Integration(t *testing.T) {
+	if !monkey.IsPatched() {
+		t.Fatal("Not running patched executable")
+	}
+
+	network.RestoreOnCleanup(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "stand-in")
+	}))
+	defer srv.Close()
+
+	network.Route("api.example.com", srv.Listener.Addr().String())
+	network.Pipe("db.internal:5432", func(conn net.Conn) {
+		_, _ = io.WriteString(conn, "pipe")
+		_ = conn.Close()
+	})
+	network.AddHost("api.example.com", "10.0.0.1")
+
+	resp, err := http.Get("http://api.example.com/v1/status")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "stand-in" {
+		t.Errorf("HTTP request not routed, returned: %q", body)
+	}
+
+	conn, err := net.Dial("tcp", "db.internal:5432")
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+
+	if data, _ := io.ReadAll(conn); string(data) != "pipe" {
+		t.Errorf("Dial not routed, returned: %q", data)
+	}
+
+	if _, err = net.DialTimeout("tcp", "example.com:80", 0); err == nil {
+		t.Error("Dial of address without route succeeded")
+	}
+
+	if addrs, err := net.LookupHost("api.example.com"); err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Errorf("LookupHost not patched, returned: %v, %v", addrs, err)
+	}
+}
@@ -0,0 +1,214 @@
+package fakenet
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// DialFunc establishes connection instead of dial to routed address.
+type DialFunc func(ctx context.Context, network string) (net.Conn, error)
+
+// Network is a set of routes used instead of real network. It's safe for concurrent use.
+type Network struct {
+	mu     sync.RWMutex
+	routes map[string]DialFunc // address or host to dial function
+	hosts  map[string][]string // host to addresses returned by lookup
+}
+
+// NewNetwork constructs Network without routes.
+func NewNetwork() *Network {
+	return &Network{
+		routes: map[string]DialFunc{},
+		hosts:  map[string][]string{},
+	}
+}
+
+// Route redirects dials of address to target. Address may be "host:port" or just "host" to redirect all ports.
+// Target is a real address (i.e. address of httptest server) dialed using same network.
+func (n *Network) Route(address, target string) {
+	n.RouteFunc(address, func(ctx context.Context, network string) (net.Conn, error) {
+		return dialTarget(ctx, network, target)
+	})
+}
+
+// RouteFunc redirects dials of address to provided function. See Route for address format.
+func (n *Network) RouteFunc(address string, dial DialFunc) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.routes[address] = dial
+}
+
+// Pipe redirects dials of address to in-process server. Server side of each connection made by net.Pipe
+// passed to serve in separate goroutine. See Route for address format.
+func (n *Network) Pipe(address string, serve func(conn net.Conn)) {
+	n.RouteFunc(address, func(context.Context, string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serve(server)
+
+		return client, nil
+	})
+}
+
+// AddHost sets addresses returned by lookup of host. Dials of host without own route are routed
+// by routes of these addresses, tried in order.
+func (n *Network) AddHost(host string, addrs ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.hosts[host] = append([]string(nil), addrs...)
+}
+
+// TB is a part of testing.TB used by RestoreOnCleanup.
+type TB interface {
+	Helper()
+	Cleanup(func())
+}
+
+// RestoreOnCleanup saves current routes and hosts and restores them when test finishes.
+func (n *Network) RestoreOnCleanup(tb TB) {
+	tb.Helper()
+
+	n.mu.RLock()
+	routes := make(map[string]DialFunc, len(n.routes))
+	for address, dial := range n.routes {
+		routes[address] = dial
+	}
+
+	hosts := make(map[string][]string, len(n.hosts))
+	for host, addrs := range n.hosts {
+		hosts[host] = addrs
+	}
+	n.mu.RUnlock()
+
+	tb.Cleanup(func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		n.routes, n.hosts = routes, hosts
+	})
+}
+
+func (n *Network) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dial, ok := n.route(address)
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: ErrNoRoute.Error(), Addr: address}}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	conn, err := dial(ctx, network)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	return conn, nil
+}
+
+func (n *Network) route(address string) (DialFunc, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if dial, ok := n.routes[address]; ok {
+		return dial, true
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+
+	if dial, ok := n.routes[host]; ok {
+		return dial, true
+	}
+
+	for _, addr := range n.hosts[host] {
+		if dial, ok := n.routes[net.JoinHostPort(addr, port)]; ok {
+			return dial, true
+		}
+
+		if dial, ok := n.routes[addr]; ok {
+			return dial, true
+		}
+	}
+
+	return nil, false
+}
+
+func (n *Network) lookupHost(host string) ([]string, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{host}, nil
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	addrs, ok := n.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return append([]string(nil), addrs...), nil
+}
+
+// dialTarget dials real address bypassing net.Dialer which may be replaced.
+// Dial functions used for this don't accept context, so it's checked by dialWithContext.
+func dialTarget(ctx context.Context, network, target string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		addr, err := net.ResolveTCPAddr(network, target)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialWithContext(ctx, func() (net.Conn, error) { return net.DialTCP(network, nil, addr) })
+	case "udp", "udp4", "udp6":
+		addr, err := net.ResolveUDPAddr(network, target)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialWithContext(ctx, func() (net.Conn, error) { return net.DialUDP(network, nil, addr) })
+	case "unix", "unixgram", "unixpacket":
+		addr, err := net.ResolveUnixAddr(network, target)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialWithContext(ctx, func() (net.Conn, error) { return net.DialUnix(network, nil, addr) })
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+}
+
+// dialWithContext calls dial in separate goroutine and returns context error if context is done before dial finished.
+// Connection established after this is closed.
+func dialWithContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
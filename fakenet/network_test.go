@@ -0,0 +1,150 @@
+package fakenet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetworkRoute(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+
+	n := NewNetwork()
+	n.Route("api.example.com", ln.Addr().String())
+
+	conn, err := n.dial(context.Background(), "tcp", "api.example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+
+	defer conn.Close()
+
+	if data, _ := io.ReadAll(conn); string(data) != "hello" {
+		t.Errorf("Unexpected data: %q", data)
+	}
+
+	_, err = n.dial(context.Background(), "tcp", "other.example.com:443")
+
+	var addrErr *net.AddrError
+	if !errors.As(err, &addrErr) || addrErr.Err != ErrNoRoute.Error() {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestNetworkPipe(t *testing.T) {
+	n := NewNetwork()
+	n.Pipe("db.internal:5432", func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	})
+
+	conn, err := n.dial(context.Background(), "tcp", "db.internal:5432")
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Unexpected echo: %q, %v", buf, err)
+	}
+}
+
+func TestDialWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	unblock := make(chan struct{})
+	closed := make(chan struct{})
+
+	_, err := dialWithContext(ctx, func() (net.Conn, error) {
+		<-unblock
+
+		client, server := net.Pipe()
+		go func() {
+			_, _ = server.Read(make([]byte, 1))
+			close(closed)
+		}()
+
+		return client, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	close(unblock)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Connection established after deadline was not closed")
+	}
+}
+
+func TestNetworkLookupHost(t *testing.T) {
+	n := NewNetwork()
+	n.AddHost("api.example.com", "10.0.0.1")
+
+	if addrs, err := n.lookupHost("api.example.com"); err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Errorf("Unexpected lookup result: %v, %v", addrs, err)
+	}
+
+	if addrs, err := n.lookupHost("127.0.0.1"); err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Errorf("Unexpected lookup result for IP: %v, %v", addrs, err)
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := n.lookupHost("unknown.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestNetworkRouteByHost(t *testing.T) {
+	n := NewNetwork()
+	n.Pipe("10.0.0.2:5432", func(conn net.Conn) {
+		_, _ = conn.Write([]byte("second"))
+		_ = conn.Close()
+	})
+	n.AddHost("db.internal", "10.0.0.1", "10.0.0.2")
+
+	conn, err := n.dial(context.Background(), "tcp", "db.internal:5432")
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+
+	defer conn.Close()
+
+	if data, _ := io.ReadAll(conn); string(data) != "second" {
+		t.Errorf("Unexpected data: %q", data)
+	}
+
+	_, err = n.dial(context.Background(), "tcp", "db.internal:5433")
+
+	var addrErr *net.AddrError
+	if !errors.As(err, &addrErr) || addrErr.Err != ErrNoRoute.Error() {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+// Package fakeos provides replacements of functions of package os reading global state of process:
+// environment, host name, working and home directories and, optionally, files. Replacements use Sandbox,
+// so code reading process state directly may be isolated without refactoring.
+//
+// Sandbox takes effect in patched executable, so call Register (and RegisterFiles if files should be isolated too)
+// before PatchAndExec of the Patcher. Whole process sees sandbox then, including standard library
+// (i.e. os.TempDir reads TMPDIR from it), real environment remains available via syscall.Getenv.
+package fakeos
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/xakep666/monkey"
+)
+
+// osHostname is a name of function called by os.Hostname. It's used because os.Hostname is inlined.
+const osHostname = "os.hostname"
+
+var (
+	// empty sandbox isolates calls made before Register from real process state
+	defaultSandbox = newSandbox("")
+	currentSandbox atomic.Pointer[Sandbox]
+)
+
+// Register registers replacements of os.Getenv, os.LookupEnv, os.Hostname, os.Getwd and os.UserHomeDir in patcher.
+// Replacements use provided sandbox, which replaces sandbox passed to previous Register or RegisterFiles call.
+// Options are passed to registration of each function.
+func Register(p *monkey.Patcher, sandbox *Sandbox, opts ...monkey.RegisterOption) {
+	currentSandbox.Store(sandbox)
+
+	monkey.RegisterReplacement(p, os.Getenv, getenv, opts...)
+	monkey.RegisterReplacement(p, os.LookupEnv, lookupEnv, opts...)
+	monkey.RegisterReplacement(p, os.Hostname, hostname, opts...)
+	p.RegisterNamedReplacement(osHostname, hostname, opts...)
+	monkey.RegisterReplacement(p, os.Getwd, getwd, opts...)
+	monkey.RegisterReplacement(p, os.UserHomeDir, userHomeDir, opts...)
+}
+
+// RegisterFiles registers replacements of os.OpenFile (so os.Open and os.Create) and os.ReadFile in patcher.
+// Files are looked up in provided sandbox (see Sandbox.SetFiles), relative names resolved using its working directory.
+// Options (i.e. monkey.WithOverride) are passed to both registrations.
+func RegisterFiles(p *monkey.Patcher, sandbox *Sandbox, opts ...monkey.RegisterOption) {
+	currentSandbox.Store(sandbox)
+
+	monkey.RegisterReplacement(p, os.OpenFile, openFile, opts...)
+	monkey.RegisterReplacement(p, os.ReadFile, readFile, opts...)
+}
+
+func sandbox() *Sandbox {
+	if s := currentSandbox.Load(); s != nil {
+		return s
+	}
+
+	return defaultSandbox
+}
+
+func getenv(key string) string {
+	value, _ := sandbox().getenv(key)
+	return value
+}
+
+func lookupEnv(key string) (string, bool) { return sandbox().getenv(key) }
+
+func hostname() (string, error) { return sandbox().getHostname(), nil }
+
+func getwd() (string, error) { return sandbox().getWorkDir(), nil }
+
+func userHomeDir() (string, error) { return sandbox().getHomeDir(), nil }
+
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return sandbox().openFile(name, flag, perm)
+}
+
+func readFile(name string) ([]byte, error) {
+	f, err := sandbox().openFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
@@ -0,0 +1,83 @@
+//go:build integration
+
+package fakeos_test
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/xakep666/monkey"
+	"github.com/xakep666/monkey/fakeos"
+)
+
+var sandbox = fakeos.NewSandbox()
+
+func init() {
+	monkey.Default().Apply(func(patcher *monkey.Patcher) {
+		fakeos.Register(patcher, sandbox)
+		fakeos.RegisterFiles(patcher, sandbox)
+	})
+}
+
+func TestMain(m *testing.M) {
+	monkey.MustPatchAndExec()
+
+	code := m.Run()
+	_ = sandbox.Remove()
+	os.Exit(code)
+}
+
+func TestFakeOS_Integration(t *testing.T) {
+	if !monkey.IsPatched() {
+		t.Fatal("Not running patched executable")
+	}
+
+	sandbox.RestoreOnCleanup(t)
+	sandbox.Setenv("APP_MODE", "test")
+	sandbox.SetHostname("test-host")
+	sandbox.Chdir("/srv")
+
+	if err := sandbox.SetFiles(fstest.MapFS{"srv/config.json": {Data: []byte("{}")}}); err != nil {
+		t.Fatalf("Set files: %s", err)
+	}
+
+	if mode := os.Getenv("APP_MODE"); mode != "test" {
+		t.Errorf("Getenv not patched, returned: %s", mode)
+	}
+
+	if _, ok := os.LookupEnv("PATH"); ok {
+		t.Error("LookupEnv not patched, real variable found")
+	}
+
+	if hostname, _ := os.Hostname(); hostname != "test-host" {
+		t.Errorf("Hostname not patched, returned: %s", hostname)
+	}
+
+	if wd, _ := os.Getwd(); wd != "/srv" {
+		t.Errorf("Getwd not patched, returned: %s", wd)
+	}
+
+	if home, _ := os.UserHomeDir(); home != "/home" {
+		t.Errorf("UserHomeDir not patched, returned: %s", home)
+	}
+
+	if data, err := os.ReadFile("config.json"); err != nil || string(data) != "{}" {
+		t.Errorf("ReadFile not patched, returned: %q, %v", data, err)
+	}
+
+	f, err := os.Create("/srv/output.txt")
+	if err != nil {
+		t.Fatalf("Create not patched: %s", err)
+	}
+
+	_, _ = f.WriteString("result")
+	_ = f.Close()
+
+	f, err = os.Open("output.txt")
+	if err != nil {
+		t.Fatalf("Open not patched: %s", err)
+	}
+
+	defer f.Close()
+}
@@ -0,0 +1,290 @@
+package fakeos
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing/fstest"
+)
+
+// Sandbox is a fake state of process: environment, host name, working and home directories and files.
+// It's safe for concurrent use.
+type Sandbox struct {
+	mu       sync.RWMutex
+	env      map[string]string
+	hostname string
+	workDir  string
+	homeDir  string
+	files    fstest.MapFS
+	root     string // directory containing materialized files
+	tempDir  string // directory where root is created
+}
+
+// NewSandbox constructs Sandbox with empty environment, "localhost" host name,
+// "/" working directory, "/home" home directory and no files.
+func NewSandbox() *Sandbox {
+	// resolved once because os.TempDir uses environment which may be replaced
+	return newSandbox(os.TempDir())
+}
+
+func newSandbox(tempDir string) *Sandbox {
+	return &Sandbox{
+		env:      map[string]string{},
+		hostname: "localhost",
+		workDir:  string(filepath.Separator),
+		homeDir:  filepath.Join(string(filepath.Separator), "home"),
+		tempDir:  tempDir,
+	}
+}
+
+// Setenv sets environment variable.
+func (s *Sandbox) Setenv(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.env[key] = value
+}
+
+// Unsetenv removes environment variable.
+func (s *Sandbox) Unsetenv(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.env, key)
+}
+
+// SetHostname sets host name.
+func (s *Sandbox) SetHostname(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hostname = hostname
+}
+
+// Chdir sets working directory. It's used to resolve relative file names too.
+func (s *Sandbox) Chdir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.workDir = filepath.Clean(dir)
+}
+
+// SetHomeDir sets home directory.
+func (s *Sandbox) SetHomeDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.homeDir = dir
+}
+
+// SetFiles replaces files of sandbox. Keys of files are slash-separated paths relative to root of sandbox.
+// Files returned by os.Open and os.Create must be backed by real descriptors, so files are stored in
+// temporary directory and previous content of sandbox is removed.
+func (s *Sandbox) SetFiles(files fstest.MapFS) error {
+	root, err := materialize(s.tempDir, files)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	prevRoot := s.root
+	s.root, s.files = root, files
+	s.mu.Unlock()
+
+	return removeRoot(prevRoot)
+}
+
+// TB is a part of testing.TB used by RestoreOnCleanup.
+type TB interface {
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...any)
+}
+
+// RestoreOnCleanup saves current state of sandbox and restores it when test finishes.
+// Files modified by test are restored to content set by SetFiles.
+func (s *Sandbox) RestoreOnCleanup(tb TB) {
+	tb.Helper()
+
+	s.mu.RLock()
+	env := make(map[string]string, len(s.env))
+	for key, value := range s.env {
+		env[key] = value
+	}
+	hostname, workDir, homeDir, files, hasFiles := s.hostname, s.workDir, s.homeDir, s.files, s.root != ""
+	s.mu.RUnlock()
+
+	tb.Cleanup(func() {
+		s.mu.Lock()
+		s.env, s.hostname, s.workDir, s.homeDir = env, hostname, workDir, homeDir
+		s.mu.Unlock()
+
+		if hasFiles {
+			if err := s.SetFiles(files); err != nil {
+				tb.Errorf("Restore sandbox files: %s", err)
+			}
+		}
+	})
+}
+
+// Remove removes temporary directory containing files.
+func (s *Sandbox) Remove() error {
+	s.mu.Lock()
+	root := s.root
+	s.root, s.files = "", nil
+	s.mu.Unlock()
+
+	return removeRoot(root)
+}
+
+func (s *Sandbox) getenv(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.env[key]
+
+	return value, ok
+}
+
+func (s *Sandbox) getHostname() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.hostname
+}
+
+func (s *Sandbox) getWorkDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.workDir
+}
+
+func (s *Sandbox) getHomeDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.homeDir
+}
+
+// openFile opens file with provided name inside sandbox. Sandbox without files acts like empty one.
+func (s *Sandbox) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	location, ok := s.resolve(name)
+	if !ok {
+		if err := s.SetFiles(fstest.MapFS{}); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		location, _ = s.resolve(name)
+	}
+
+	return openReal(name, location, flag, perm)
+}
+
+// resolve returns location of file with provided name in temporary directory.
+// It reports false if sandbox has no files directory.
+func (s *Sandbox) resolve(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.root == "" {
+		return "", false
+	}
+
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(s.workDir, name)
+	}
+
+	// cleaning of absolute path removes leading "..", so result is always inside root
+	return filepath.Join(s.root, strings.TrimPrefix(filepath.Clean(name), filepath.VolumeName(name))), true
+}
+
+// materialize writes files to new temporary directory inside dir.
+func materialize(dir string, files fstest.MapFS) (root string, err error) {
+	root, err = os.MkdirTemp(dir, "fakeos-")
+	if err != nil {
+		return "", fmt.Errorf("create sandbox directory: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(root)
+		}
+	}()
+
+	for name, file := range files {
+		if !fs.ValidPath(name) {
+			return "", fmt.Errorf("invalid file name %q", name)
+		}
+
+		dst := filepath.Join(root, filepath.FromSlash(name))
+		if file.Mode.IsDir() {
+			if err = os.MkdirAll(dst, 0o755); err != nil {
+				return "", fmt.Errorf("create directory: %w", err)
+			}
+
+			continue
+		}
+
+		if err = os.MkdirAll(filepath.Join(root, filepath.FromSlash(path.Dir(name))), 0o755); err != nil {
+			return "", fmt.Errorf("create directory: %w", err)
+		}
+
+		if err = writeReal(name, dst, file); err != nil {
+			return "", err
+		}
+	}
+
+	return root, nil
+}
+
+func writeReal(name, dst string, file *fstest.MapFile) error {
+	perm := file.Mode.Perm()
+	if perm == 0 {
+		perm = 0o644
+	}
+
+	f, err := openReal(name, dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(file.Data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+
+	return nil
+}
+
+func removeRoot(root string) error {
+	if root == "" {
+		return nil
+	}
+
+	if err := os.RemoveAll(root); err != nil {
+		return fmt.Errorf("remove sandbox directory: %w", err)
+	}
+
+	return nil
+}
+
+// openReal opens file located at location bypassing os.OpenFile which may be replaced.
+// Returned file has provided name.
+func openReal(name, location string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := syscall.Open(location, flag|syscall.O_CLOEXEC, uint32(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,105 @@
+package fakeos
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSandboxFiles(t *testing.T) {
+	s := newSandbox(t.TempDir())
+	defer s.Remove()
+
+	err := s.SetFiles(fstest.MapFS{
+		"etc/app.conf": {Data: []byte("key=value")},
+		"var/log":      {Mode: fs.ModeDir},
+	})
+	if err != nil {
+		t.Fatalf("Set files: %s", err)
+	}
+
+	s.Chdir("/etc")
+
+	f, err := s.openFile("app.conf", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open file: %s", err)
+	}
+
+	data, err := io.ReadAll(f)
+	_ = f.Close()
+
+	if err != nil || string(data) != "key=value" {
+		t.Errorf("Unexpected content: %q, %v", data, err)
+	}
+
+	if f.Name() != "app.conf" {
+		t.Errorf("Unexpected file name: %s", f.Name())
+	}
+
+	// parent directories of root are not reachable
+	f, err = s.openFile("../../../../etc/app.conf", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Path escaped sandbox: %s", err)
+	}
+
+	_ = f.Close()
+
+	if _, err = s.openFile("/etc/passwd", os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	f, err = s.openFile("/var/log/app.log", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("Create file: %s", err)
+	}
+
+	_ = f.Close()
+}
+
+func TestSandboxRestoreOnCleanup(t *testing.T) {
+	s := newSandbox(t.TempDir())
+	defer s.Remove()
+
+	s.Setenv("KEY", "value")
+
+	if err := s.SetFiles(fstest.MapFS{"file": {Data: []byte("original")}}); err != nil {
+		t.Fatalf("Set files: %s", err)
+	}
+
+	t.Run("modify", func(t *testing.T) {
+		s.RestoreOnCleanup(t)
+
+		s.Setenv("KEY", "other")
+		s.Unsetenv("KEY")
+		s.SetHostname("test-host")
+
+		f, err := s.openFile("/file", os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			t.Fatalf("Open file: %s", err)
+		}
+
+		_ = f.Close()
+	})
+
+	if value, ok := s.getenv("KEY"); !ok || value != "value" {
+		t.Errorf("Environment not restored: %q, %v", value, ok)
+	}
+
+	if hostname := s.getHostname(); hostname != "localhost" {
+		t.Errorf("Host name not restored: %s", hostname)
+	}
+
+	f, err := s.openFile("/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open file: %s", err)
+	}
+
+	defer f.Close()
+
+	if data, _ := io.ReadAll(f); string(data) != "original" {
+		t.Errorf("File not restored: %q", data)
+	}
+}
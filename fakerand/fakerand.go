@@ -0,0 +1,195 @@
+// Package fakerand provides replacements making top-level functions of math/rand, math/rand/v2
+// and crypto/rand.Read deterministic. All of them use single generator initialized by seed.
+//
+// Seed is chosen randomly on start unless it's specified by environment variable (see SeedEnvVar),
+// so failed test may be reproduced by running it with same seed (see Report).
+//
+// Generator is not involved until Register-ed replacements are applied by PatchAndExec of the Patcher.
+// After this crypto/rand.Read returns predictable bytes to every caller in process, including crypto/tls,
+// key generation and random identifiers, so fakerand must not be registered in processes
+// talking to real services or producing secrets.
+package fakerand
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"hash/maphash"
+	"math/rand"
+	randv2 "math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"github.com/xakep666/monkey"
+)
+
+// SeedEnvVar is a name of environment variable containing seed (unsigned decimal integer) used instead of random one.
+const SeedEnvVar = "FAKERAND_SEED"
+
+// runtimeSourceUint64 is a name of method called by top-level functions of math/rand/v2. They are inlined
+// and source is unexported, so method replaced by name.
+const runtimeSourceUint64 = "math/rand/v2.(*runtimeSource).Uint64"
+
+var (
+	seed      uint64
+	source    = &lockedSource{}
+	generator = randv2.New(source)
+)
+
+func init() {
+	s, err := seedFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	SetSeed(s)
+}
+
+// Register registers replacements of top-level functions of math/rand and math/rand/v2 and crypto/rand.Read.
+// Note that crypto/rand.Read is replaced for whole process, see package documentation.
+// Registration options (i.e. monkey.WithPriority) are passed to each replacement.
+func Register(p *monkey.Patcher, opts ...monkey.RegisterOption) {
+	monkey.RegisterReplacement(p, rand.Int, randInt, opts...)
+	monkey.RegisterReplacement(p, rand.Intn, intn, opts...)
+	monkey.RegisterReplacement(p, rand.Int31, int31, opts...)
+	monkey.RegisterReplacement(p, rand.Int31n, int31n, opts...)
+	monkey.RegisterReplacement(p, rand.Int63, int63, opts...)
+	monkey.RegisterReplacement(p, rand.Int63n, int63n, opts...)
+	monkey.RegisterReplacement(p, rand.Uint32, uint32Value, opts...)
+	monkey.RegisterReplacement(p, rand.Uint64, uint64Value, opts...)
+	monkey.RegisterReplacement(p, rand.Float32, float32Value, opts...)
+	monkey.RegisterReplacement(p, rand.Float64, float64Value, opts...)
+	monkey.RegisterReplacement(p, rand.NormFloat64, normFloat64, opts...)
+	monkey.RegisterReplacement(p, rand.ExpFloat64, expFloat64, opts...)
+	monkey.RegisterReplacement(p, rand.Perm, perm, opts...)
+	monkey.RegisterReplacement(p, rand.Shuffle, shuffle, opts...)
+	monkey.RegisterReplacement(p, rand.Read, read, opts...)
+	monkey.RegisterReplacement(p, crand.Read, read, opts...)
+
+	// covers calls by function value and keeps global source of math/rand/v2 in executable
+	monkey.RegisterReplacement(p, randv2.Uint64, uint64Value, opts...)
+	p.RegisterNamedReplacement(runtimeSourceUint64, runtimeSourceUint64Value, opts...)
+}
+
+// Seed returns seed of generator.
+func Seed() uint64 {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	return seed
+}
+
+// SetSeed re-initializes generator by provided seed. It's useful to get same values in each test.
+func SetSeed(s uint64) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	seed = s
+	source.pcg.Seed(s, s)
+}
+
+// TB is a part of testing.TB used by Report.
+type TB interface {
+	Cleanup(func())
+	Failed() bool
+	Logf(format string, args ...any)
+}
+
+// Report logs seed if test failed, so it may be reproduced by setting SeedEnvVar.
+func Report(tb TB) {
+	tb.Cleanup(func() {
+		if tb.Failed() {
+			tb.Logf("fakerand seed: %d (set %s=%d to reproduce)", Seed(), SeedEnvVar, Seed())
+		}
+	})
+}
+
+func seedFromEnv() (uint64, error) {
+	value, ok := os.LookupEnv(SeedEnvVar)
+	if !ok {
+		// hash of random seed doesn't depend on functions which may be replaced
+		return new(maphash.Hash).Sum64(), nil
+	}
+
+	s, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", SeedEnvVar, err)
+	}
+
+	return s, nil
+}
+
+// lockedSource is a PCG source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	pcg randv2.PCG
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pcg.Uint64()
+}
+
+func uint64Value() uint64 { return source.Uint64() }
+
+// runtimeSourceUint64Value replaces method of source used by math/rand/v2, receiver is ignored.
+func runtimeSourceUint64Value(unsafe.Pointer) uint64 { return source.Uint64() }
+
+func randInt() int { return generator.Int() }
+
+func int31() int32 { return generator.Int32() }
+
+func int63() int64 { return generator.Int64() }
+
+func uint32Value() uint32 { return generator.Uint32() }
+
+func float32Value() float32 { return generator.Float32() }
+
+func float64Value() float64 { return generator.Float64() }
+
+func normFloat64() float64 { return generator.NormFloat64() }
+
+func expFloat64() float64 { return generator.ExpFloat64() }
+
+func perm(n int) []int { return generator.Perm(n) }
+
+func shuffle(n int, swap func(i, j int)) { generator.Shuffle(n, swap) }
+
+func intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+
+	return generator.IntN(n)
+}
+
+func int31n(n int32) int32 {
+	if n <= 0 {
+		panic("invalid argument to Int31n")
+	}
+
+	return generator.Int32N(n)
+}
+
+func int63n(n int64) int64 {
+	if n <= 0 {
+		panic("invalid argument to Int63n")
+	}
+
+	return generator.Int64N(n)
+}
+
+func read(b []byte) (int, error) {
+	for i := 0; i < len(b); i += 8 {
+		v := source.Uint64()
+		for j := i; j < len(b) && j < i+8; j++ {
+			b[j] = byte(v)
+			v >>= 8
+		}
+	}
+
+	return len(b), nil
+}
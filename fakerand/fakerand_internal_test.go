@@ -0,0 +1,52 @@
+package fakerand
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSetSeed(t *testing.T) {
+	SetSeed(42)
+	first := []int{intn(100), randInt(), int(int63n(100))}
+	firstBytes := make([]byte, 13)
+	_, _ = read(firstBytes)
+
+	SetSeed(42)
+	second := []int{intn(100), randInt(), int(int63n(100))}
+	secondBytes := make([]byte, 13)
+	_, _ = read(secondBytes)
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Values differ for same seed: %v and %v", first, second)
+			break
+		}
+	}
+
+	if !bytes.Equal(firstBytes, secondBytes) {
+		t.Errorf("Bytes differ for same seed: %x and %x", firstBytes, secondBytes)
+	}
+
+	if seed := Seed(); seed != 42 {
+		t.Errorf("Unexpected seed: %d", seed)
+	}
+}
+
+func TestSeedFromEnv(t *testing.T) {
+	t.Setenv(SeedEnvVar, "12345")
+
+	seed, err := seedFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if seed != 12345 {
+		t.Errorf("Unexpected seed: %d", seed)
+	}
+
+	t.Setenv(SeedEnvVar, "abc")
+
+	if _, err = seedFromEnv(); err == nil {
+		t.Error("Invalid seed accepted")
+	}
+}
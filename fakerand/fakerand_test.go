@@ -0,0 +1,50 @@
+//go:build integration
+
+package fakerand_test
+
+import (
+	crand "crypto/rand"
+	"math/rand"
+	randv2 "math/rand/v2"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey"
+	"github.com/xakep666/monkey/fakerand"
+)
+
+func init() {
+	fakerand.Register(monkey.Default())
+}
+
+func TestMain(m *testing.M) {
+	monkey.MustPatchAndExec()
+	os.Exit(m.Run())
+}
+
+func values() []int {
+	b := make([]byte, 4)
+	_, _ = crand.Read(b)
+
+	return []int{rand.Intn(1000), rand.Int(), randv2.IntN(1000), randv2.N(1000), int(b[0]), int(b[3])}
+}
+
+func TestFakeRand_Integration(t *testing.T) {
+	if !monkey.IsPatched() {
+		t.Fatal("Not running patched executable")
+	}
+
+	fakerand.Report(t)
+
+	fakerand.SetSeed(42)
+	first := values()
+
+	fakerand.SetSeed(42)
+	second := values()
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Random values not reproduced: %v and %v", first, second)
+		}
+	}
+}
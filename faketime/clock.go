@@ -0,0 +1,217 @@
+package faketime
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is a manually controlled clock. Time changes only by Set and Advance calls,
+// timers and sleepers with reached deadlines are fired during these calls. It's safe for concurrent use.
+type Clock struct {
+	mu       sync.Mutex
+	slept    *sync.Cond // signalled when goroutine falls asleep
+	now      time.Time
+	pending  timerHeap
+	sleepers int
+	seq      uint64
+}
+
+// NewClock constructs Clock showing provided time.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.slept = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// Now returns current time of clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Since returns time elapsed since t according to clock.
+func (c *Clock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+// Until returns duration until t according to clock.
+func (c *Clock) Until(t time.Time) time.Duration { return t.Sub(c.Now()) }
+
+// Set moves clock to provided time firing all timers with deadline before or equal to it in order of deadlines.
+// Moving clock backwards doesn't fire anything.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.pending) > 0 && !c.pending[0].when.After(t) {
+		tm := c.pending[0]
+		c.now = tm.when
+		c.fire(tm)
+	}
+
+	c.now = t
+}
+
+// Advance moves clock forward by d. See Set for details.
+func (c *Clock) Advance(d time.Duration) { c.Set(c.Now().Add(d)) }
+
+// Sleep blocks until clock advanced by d.
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	ch := make(chan time.Time, 1)
+	c.start(&timer{ch: ch, sleeper: true}, d)
+	<-ch
+}
+
+// After returns channel receiving current time when clock advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.start(&timer{ch: ch}, d)
+
+	return ch
+}
+
+// BlockUntil blocks until count of goroutines sleeping in Sleep becomes at least n.
+// It's useful to make sure that tested code started to wait before advancing clock.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.sleepers < n {
+		c.slept.Wait()
+	}
+}
+
+// timer is a pending action of clock. Exactly one of ch and f is set.
+type timer struct {
+	when    time.Time
+	period  time.Duration // non-zero for tickers
+	ch      chan time.Time
+	f       func()
+	sleeper bool   // timer created by Sleep
+	seq     uint64 // keeps order of timers with same deadline
+	index   int    // position in heap, -1 if not pending
+}
+
+// start schedules timer to fire after d.
+func (c *Clock) start(tm *timer, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.schedule(tm, d)
+}
+
+// stop removes timer from pending ones. It reports whether timer was pending.
+func (c *Clock) stop(tm *timer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.unschedule(tm)
+}
+
+// reset reschedules timer to fire after d. It reports whether timer was pending.
+func (c *Clock) reset(tm *timer, d, period time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wasPending := c.unschedule(tm)
+	tm.period = period
+	c.schedule(tm, d)
+
+	return wasPending
+}
+
+func (c *Clock) schedule(tm *timer, d time.Duration) {
+	c.seq++
+	tm.when = c.now.Add(d)
+	tm.seq = c.seq
+	heap.Push(&c.pending, tm)
+
+	if tm.sleeper {
+		c.sleepers++
+		c.slept.Broadcast()
+	}
+}
+
+func (c *Clock) unschedule(tm *timer) bool {
+	if tm.ch != nil {
+		// like runtime timers since go1.23, no stale values can be received after stop or reset
+		select {
+		case <-tm.ch:
+		default:
+		}
+	}
+
+	if tm.index < 0 {
+		return false
+	}
+
+	heap.Remove(&c.pending, tm.index)
+
+	return true
+}
+
+// fire runs first pending timer. Tickers are rescheduled, other timers become stopped.
+func (c *Clock) fire(tm *timer) {
+	if tm.period > 0 {
+		tm.when = tm.when.Add(tm.period)
+		heap.Fix(&c.pending, 0)
+	} else {
+		heap.Pop(&c.pending)
+	}
+
+	if tm.sleeper {
+		c.sleepers--
+	}
+
+	if tm.f != nil {
+		go tm.f()
+		return
+	}
+
+	// like runtime timers, drop value if previous one wasn't received
+	select {
+	case tm.ch <- c.now:
+	default:
+	}
+}
+
+// timerHeap is a min-heap of timers ordered by deadline.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	tm := x.(*timer)
+	tm.index = len(*h)
+	*h = append(*h, tm)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	tm := old[len(old)-1]
+	old[len(old)-1] = nil
+	tm.index = -1
+	*h = old[:len(old)-1]
+
+	return tm
+}
@@ -0,0 +1,152 @@
+package faketime
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC)
+
+func TestClockSetAdvance(t *testing.T) {
+	c := NewClock(testStart)
+
+	c.Advance(time.Hour)
+	if now := c.Now(); !now.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("Unexpected time after advance: %s", now)
+	}
+
+	c.Set(testStart)
+	if now := c.Now(); !now.Equal(testStart) {
+		t.Errorf("Unexpected time after set: %s", now)
+	}
+
+	if since := c.Since(testStart.Add(-time.Minute)); since != time.Minute {
+		t.Errorf("Unexpected since: %s", since)
+	}
+
+	if until := c.Until(testStart.Add(time.Minute)); until != time.Minute {
+		t.Errorf("Unexpected until: %s", until)
+	}
+}
+
+func TestClockSleep(t *testing.T) {
+	c := NewClock(testStart)
+	done := make(chan time.Time)
+
+	go func() {
+		c.Sleep(time.Second)
+		done <- c.Now()
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Second - 1)
+
+	select {
+	case <-done:
+		t.Fatal("Sleeper woken before deadline")
+	default:
+	}
+
+	c.Advance(1)
+
+	if now := <-done; !now.Equal(testStart.Add(time.Second)) {
+		t.Errorf("Unexpected time after sleep: %s", now)
+	}
+}
+
+func TestClockTimersOrder(t *testing.T) {
+	c := NewClock(testStart)
+
+	late := c.After(2 * time.Second)
+	early := c.After(time.Second)
+
+	c.Advance(time.Minute)
+
+	if fired := <-early; !fired.Equal(testStart.Add(time.Second)) {
+		t.Errorf("Unexpected time of early timer: %s", fired)
+	}
+
+	if fired := <-late; !fired.Equal(testStart.Add(2 * time.Second)) {
+		t.Errorf("Unexpected time of late timer: %s", fired)
+	}
+
+	if now := c.Now(); !now.Equal(testStart.Add(time.Minute)) {
+		t.Errorf("Unexpected time after advance: %s", now)
+	}
+}
+
+func TestClockTicker(t *testing.T) {
+	c := NewClock(testStart)
+	ch := make(chan time.Time, 1)
+	tm := &timer{ch: ch, period: time.Second}
+	c.start(tm, time.Second)
+
+	c.Advance(time.Second)
+	if fired := <-ch; !fired.Equal(testStart.Add(time.Second)) {
+		t.Errorf("Unexpected first tick: %s", fired)
+	}
+
+	// ticks not received in time are dropped
+	c.Advance(3 * time.Second)
+	if fired := <-ch; !fired.Equal(testStart.Add(2 * time.Second)) {
+		t.Errorf("Unexpected second tick: %s", fired)
+	}
+
+	if !c.stop(tm) {
+		t.Error("Ticker was not pending")
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case fired := <-ch:
+		t.Errorf("Stopped ticker fired at %s", fired)
+	default:
+	}
+}
+
+func TestClockStopReset(t *testing.T) {
+	c := NewClock(testStart)
+	ch := make(chan time.Time, 1)
+	tm := &timer{ch: ch}
+	c.start(tm, time.Second)
+
+	c.Advance(time.Second)
+	if c.stop(tm) {
+		t.Error("Fired timer reported as pending")
+	}
+
+	select {
+	case fired := <-ch:
+		t.Errorf("Stale value received after stop: %s", fired)
+	default:
+	}
+
+	if c.reset(tm, time.Second, 0) {
+		t.Error("Stopped timer reported as pending")
+	}
+
+	if !c.reset(tm, 2*time.Second, 0) {
+		t.Error("Reset timer was not pending")
+	}
+
+	c.Advance(time.Second)
+	select {
+	case fired := <-ch:
+		t.Errorf("Timer fired before new deadline at %s", fired)
+	default:
+	}
+
+	c.Advance(time.Second)
+	if fired := <-ch; !fired.Equal(testStart.Add(3 * time.Second)) {
+		t.Errorf("Unexpected time of reset timer: %s", fired)
+	}
+}
+
+func TestClockAfterFunc(t *testing.T) {
+	c := NewClock(testStart)
+	done := make(chan struct{})
+	c.start(&timer{f: func() { close(done) }}, time.Second)
+
+	c.Advance(time.Second)
+	<-done
+}
@@ -0,0 +1,232 @@
+// Package faketime provides replacements for functions of package time working with controllable Clock.
+// It allows to test time-dependent code deterministically without dependency injection.
+//
+// Clock starts to move only by its own methods once patched executable runs: Register in TestMain
+// (or init) before PatchAndExec of the same Patcher. All code in process using package time observes fake clock
+// then, including timers created by standard library (i.e. context deadlines and alarm of "go test -timeout"),
+// so test which doesn't advance clock may hang instead of timing out. Runtime internals (i.e. network poller)
+// are not affected.
+package faketime
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/xakep666/monkey"
+)
+
+// Epoch is a time shown by clock which replacements fall back to if they're called before Register,
+// i.e. from package initializers of patched executable.
+var Epoch = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	defaultClock = NewClock(Epoch)
+	currentClock atomic.Pointer[Clock]
+
+	// runtime timer address to timerEntry, uintptr used to not prevent timers from collection
+	timers sync.Map
+)
+
+// timerEntry binds timer to clock where it was created.
+type timerEntry struct {
+	clock *Clock
+	timer *timer
+}
+
+// Register registers replacements of time.Now, time.Since, time.Until, time.Sleep, time.After, time.NewTimer,
+// time.AfterFunc, time.NewTicker, time.Tick and methods of time.Timer and time.Ticker in patcher.
+// Replacements use provided clock, timers keep clock which was current on their creation.
+// Options (i.e. monkey.WithPriority) are passed to each of these registrations.
+func Register(p *monkey.Patcher, clock *Clock, opts ...monkey.RegisterOption) {
+	currentClock.Store(clock)
+
+	monkey.RegisterReplacement(p, time.Now, now, opts...)
+	monkey.RegisterReplacement(p, time.Since, since, opts...)
+	monkey.RegisterReplacement(p, time.Until, until, opts...)
+	monkey.RegisterReplacement(p, time.Sleep, sleep, opts...)
+	monkey.RegisterReplacement(p, time.After, after, opts...)
+	monkey.RegisterReplacement(p, time.NewTimer, newTimer, opts...)
+	monkey.RegisterReplacement(p, time.AfterFunc, afterFunc, opts...)
+	monkey.RegisterReplacement(p, time.NewTicker, newTicker, opts...)
+	monkey.RegisterReplacement(p, time.Tick, tick, opts...)
+
+	// timers not created by replacements (i.e. by inlined copies of time.NewTimer) are handled by original functions
+	if monkey.CanCallOriginal() {
+		monkey.Wrap(p, (*time.Timer).Reset, wrapResetTimer, opts...)
+		monkey.Wrap(p, (*time.Ticker).Reset, wrapResetTicker, opts...)
+		// Stop methods are inlined, so replace function called by them
+		monkey.Wrap(p, timeStopTimer, wrapStopTimer, opts...)
+
+		return
+	}
+
+	monkey.RegisterReplacement(p, (*time.Timer).Reset, wrapResetTimer(nil), opts...)
+	monkey.RegisterReplacement(p, (*time.Ticker).Reset, wrapResetTicker(nil), opts...)
+	monkey.RegisterReplacement(p, timeStopTimer, wrapStopTimer(nil), opts...)
+}
+
+func clock() *Clock {
+	if c := currentClock.Load(); c != nil {
+		return c
+	}
+
+	return defaultClock
+}
+
+func now() time.Time { return clock().Now() }
+
+func since(t time.Time) time.Duration { return clock().Since(t) }
+
+func until(t time.Time) time.Duration { return clock().Until(t) }
+
+func sleep(d time.Duration) { clock().Sleep(d) }
+
+func after(d time.Duration) <-chan time.Time { return newTimer(d).C }
+
+func newTimer(d time.Duration) *time.Timer {
+	ch := make(chan time.Time, 1)
+	t := &time.Timer{C: ch}
+	startTimer(reflect.ValueOf(t), &timer{ch: ch}, d)
+
+	return t
+}
+
+func afterFunc(d time.Duration, f func()) *time.Timer {
+	t := &time.Timer{}
+	startTimer(reflect.ValueOf(t), &timer{f: f}, d)
+
+	return t
+}
+
+func newTicker(d time.Duration) *time.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	ch := make(chan time.Time, 1)
+	t := &time.Ticker{C: ch}
+	startTimer(reflect.ValueOf(t), &timer{ch: ch, period: d}, d)
+
+	return t
+}
+
+func tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+
+	return newTicker(d).C
+}
+
+// wrapResetTimer makes replacement of time.Timer.Reset passing unknown timers to original function.
+func wrapResetTimer(original func(*time.Timer, time.Duration) bool) func(*time.Timer, time.Duration) bool {
+	return func(t *time.Timer, d time.Duration) bool {
+		entry, ok := lookupTimer(runtimeTimer(reflect.ValueOf(t)), original != nil)
+		if !ok {
+			return original(t, d)
+		}
+
+		return entry.clock.reset(entry.timer, d, 0)
+	}
+}
+
+// wrapResetTicker makes replacement of time.Ticker.Reset passing unknown tickers to original function.
+func wrapResetTicker(original func(*time.Ticker, time.Duration)) func(*time.Ticker, time.Duration) {
+	return func(t *time.Ticker, d time.Duration) {
+		if d <= 0 {
+			panic("non-positive interval for Ticker.Reset")
+		}
+
+		entry, ok := lookupTimer(runtimeTimer(reflect.ValueOf(t)), original != nil)
+		if !ok {
+			original(t, d)
+			return
+		}
+
+		entry.clock.reset(entry.timer, d, d)
+	}
+}
+
+// wrapStopTimer makes replacement of time.stopTimer passing unknown timers to original function.
+func wrapStopTimer(original func(unsafe.Pointer) bool) func(unsafe.Pointer) bool {
+	return func(t unsafe.Pointer) bool {
+		entry, ok := lookupTimer(t, original != nil)
+		if !ok {
+			return original(t)
+		}
+
+		return entry.clock.stop(entry.timer)
+	}
+}
+
+// startTimer makes time.Timer or time.Ticker pointed by v usable by their methods and schedules tm on current clock.
+func startTimer(v reflect.Value, tm *timer, d time.Duration) {
+	c := clock()
+	key := uintptr(markInitialized(v))
+
+	timers.Store(key, &timerEntry{clock: c, timer: tm})
+	runtime.SetFinalizer(v.Interface(), func(any) { timers.Delete(key) })
+
+	c.start(tm, d)
+}
+
+// lookupTimer returns entry of timer created by replacement. Unknown timer may be passed to original function
+// if it can be called, otherwise there is no way to handle it.
+func lookupTimer(t unsafe.Pointer, canCallOriginal bool) (*timerEntry, bool) {
+	entry, ok := timers.Load(uintptr(t))
+	if !ok {
+		if !canCallOriginal {
+			panic("faketime: timer was not created by replacement and original function can't be called on " + runtime.GOARCH)
+		}
+
+		return nil, false
+	}
+
+	return entry.(*timerEntry), true
+}
+
+// markInitialized sets fields checked by methods of time.Timer and time.Ticker, so they don't panic.
+// It returns pointer passed by these methods to runtime.
+func markInitialized(v reflect.Value) unsafe.Pointer {
+	v = v.Elem()
+
+	for _, name := range []string{"initTimer", "initTicker"} {
+		if field := v.FieldByName(name); field.IsValid() {
+			settable(field).SetBool(true)
+		}
+	}
+
+	// before go1.23 runtime timer was embedded and its callback was checked
+	if field := v.FieldByName("r"); field.IsValid() {
+		f := field.FieldByName("f")
+		settable(f).Set(reflect.MakeFunc(f.Type(), func([]reflect.Value) []reflect.Value { return nil }))
+	}
+
+	return runtimeTimer(v.Addr())
+}
+
+// runtimeTimer returns pointer passed to runtime by methods of time.Timer or time.Ticker pointed by v.
+func runtimeTimer(v reflect.Value) unsafe.Pointer {
+	// before go1.23 runtime timer was embedded
+	if field := v.Elem().FieldByName("r"); field.IsValid() {
+		return unsafe.Pointer(field.UnsafeAddr())
+	}
+
+	return v.UnsafePointer()
+}
+
+func settable(field reflect.Value) reflect.Value {
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
+
+// timeStopTimer is a runtime function called by Stop methods of time.Timer and time.Ticker.
+// It's pulled by linkname, this was checked with go1.27. Go1.22 and older don't restrict such pulls,
+// since go1.23 linker accepts them only if definition is marked by go:linkname. Runtime marks this one because
+// package time needs it, but it should be re-checked on Go updates.
+//
+//go:linkname timeStopTimer time.stopTimer
+func timeStopTimer(t unsafe.Pointer) bool
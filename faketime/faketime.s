@@ -0,0 +1 @@
+// Empty file allows function declarations without body (see go:linkname in faketime.go).
@@ -0,0 +1,45 @@
+package faketime
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xakep666/monkey"
+)
+
+func TestUnknownTimer(t *testing.T) {
+	if monkey.IsPatched() {
+		t.Skip("Timers are made by replacements in patched executable")
+	}
+
+	// timer made by original function
+	timer := time.NewTimer(time.Hour)
+	ticker := time.NewTicker(time.Hour)
+
+	if !wrapResetTimer((*time.Timer).Reset)(timer, time.Minute) {
+		t.Error("Timer reset by original function was not pending")
+	}
+
+	wrapResetTicker((*time.Ticker).Reset)(ticker, time.Minute)
+
+	if !wrapStopTimer(timeStopTimer)(runtimeTimer(reflect.ValueOf(timer))) {
+		t.Error("Timer stopped by original function was not pending")
+	}
+
+	if timer.Stop() {
+		t.Error("Timer is still pending")
+	}
+
+	if !wrapStopTimer(timeStopTimer)(runtimeTimer(reflect.ValueOf(ticker))) {
+		t.Error("Ticker stopped by original function was not pending")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Unknown timer accepted without original function")
+		}
+	}()
+
+	wrapStopTimer(nil)(runtimeTimer(reflect.ValueOf(timer)))
+}
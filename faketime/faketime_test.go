@@ -0,0 +1,82 @@
+//go:build integration
+
+package faketime_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xakep666/monkey"
+	"github.com/xakep666/monkey/faketime"
+)
+
+var (
+	start = time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC)
+	clock = faketime.NewClock(start)
+)
+
+func init() {
+	faketime.Register(monkey.Default(), clock)
+}
+
+func TestMain(m *testing.M) {
+	monkey.MustPatchAndExec()
+	os.Exit(m.Run())
+}
+
+func TestFakeTime_Integration(t *testing.T) {
+	if !monkey.IsPatched() {
+		t.Fatal("Not running patched executable")
+	}
+
+	if now := time.Now(); !now.Equal(clock.Now()) {
+		t.Errorf("Time not patched, returned: %s", now)
+	}
+
+	slept := make(chan struct{})
+	go func() {
+		time.Sleep(time.Minute)
+		close(slept)
+	}()
+
+	timer := time.NewTimer(time.Hour)
+	ticker := time.NewTicker(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-slept
+
+	if elapsed := time.Since(start); elapsed != time.Minute {
+		t.Errorf("Unexpected elapsed time: %s", elapsed)
+	}
+
+	if tick := <-ticker.C; !tick.Equal(start.Add(time.Second)) {
+		t.Errorf("Unexpected tick: %s", tick)
+	}
+
+	ticker.Stop()
+
+	if !timer.Stop() {
+		t.Error("Timer was not pending")
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Stopped timer reported as pending")
+	}
+
+	clock.Advance(time.Minute)
+
+	if fired := <-timer.C; !fired.Equal(start.Add(time.Minute + time.Second)) {
+		t.Errorf("Unexpected timer fire time: %s", fired)
+	}
+
+	<-ctx.Done()
+
+	if remaining := time.Until(start.Add(3 * time.Minute)); remaining != time.Minute {
+		t.Errorf("Unexpected remaining time: %s", remaining)
+	}
+}
@@ -1,6 +1,7 @@
 package monkey
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -8,32 +9,78 @@ import (
 )
 
 func copyToTemp(path string) (*os.File, error) {
-	f, err := os.Open(path)
+	tmp, err := os.CreateTemp(os.TempDir(), "*"+filepath.Ext(path))
 	if err != nil {
-		return nil, fmt.Errorf("source open failed: %w", err)
+		return nil, fmt.Errorf("create temp file failed: %w", err)
 	}
 
-	defer f.Close()
+	if err = copyTo(tmp, path); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
 
-	tmp, err := os.CreateTemp(os.TempDir(), "*"+filepath.Ext(path))
+	return tmp, nil
+}
+
+// copyToSibling copies src to new temporary file located in directory of dst,
+// so it can be renamed to dst after patching.
+func copyToSibling(src, dst string) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
 	if err != nil {
 		return nil, fmt.Errorf("create temp file failed: %w", err)
 	}
 
-	err = os.Chmod(tmp.Name(), os.ModePerm)
+	if err = copyTo(tmp, src); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+// sameFile reports whether src and existing dst are the same file.
+func sameFile(src, dst string) (bool, error) {
+	srcInfo, err := os.Stat(src)
 	if err != nil {
-		return nil, fmt.Errorf("chmod failed: %w", err)
+		return false, fmt.Errorf("source stat failed: %w", err)
+	}
+
+	dstInfo, err := os.Stat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
 	}
 
-	_, err = io.Copy(tmp, f)
 	if err != nil {
-		return nil, fmt.Errorf("copy to temp file failed: %w", err)
+		return false, fmt.Errorf("destination stat failed: %w", err)
 	}
 
-	_, err = tmp.Seek(io.SeekStart, 0)
+	return os.SameFile(srcInfo, dstInfo), nil
+}
+
+func copyTo(dst *os.File, path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("seek start failed: %w", err)
+		return fmt.Errorf("source open failed: %w", err)
 	}
 
-	return tmp, nil
+	defer f.Close()
+
+	err = os.Chmod(dst.Name(), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("chmod failed: %w", err)
+	}
+
+	_, err = io.Copy(dst, f)
+	if err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+
+	_, err = dst.Seek(io.SeekStart, 0)
+	if err != nil {
+		return fmt.Errorf("seek start failed: %w", err)
+	}
+
+	return nil
 }
@@ -1,3 +1,3 @@
 module github.com/xakep666/monkey
 
-go 1.18
+go 1.22
@@ -0,0 +1,184 @@
+package monkey
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// hookSlots is a maximum count of hooked replacements: replacements which may call original function.
+// Trampoline and gate of each one placed to own region of hookPad.
+const hookSlots = 64
+
+// hookSupported reports whether hooked replacements supported on current architecture.
+func hookSupported() bool { return replacer.SupportsHook(runtime.GOARCH) }
+
+// CanCallOriginal reports whether replacements calling original functions (see Wrap, Inject and Spy)
+// and replacements made by Return are supported on current architecture.
+func CanCallOriginal() bool { return hookSupported() }
+
+// Wrap registers replacement made by wrap from function calling original one, so replacement may handle
+// some calls by itself and pass others to original function:
+//
+//	monkey.Wrap(patcher, os.Getenv, func(getenv func(string) string) func(string) string {
+//		return func(key string) string {
+//			if key == "HOME" {
+//				return "/home/test"
+//			}
+//
+//			return getenv(key)
+//		}
+//	})
+//
+// Replacement is called via dispatch table, so like Inject this works only on some architectures
+// (see CanCallOriginal), only for current executable and only for functions beginning with usual prologue.
+func Wrap[T any](p *Patcher, original T, wrap func(original T) T, opts ...RegisterOption) {
+	reg := registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}
+
+	h, err := newHookedFunc(original)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+
+	replacement := reflect.ValueOf(wrap(reflect.MakeFunc(h.funcType, h.call).Interface().(T)))
+	if replacement.IsNil() {
+		p.fail(fmt.Errorf("%s: %w", h.name, ErrFunctionNotFound))
+		return
+	}
+
+	p.registerDispatched(h.name, dispatchedReplacement{
+		value: replacement,
+		label: "monkey.Wrap(" + h.name + ")",
+		hook:  true,
+	}, reg)
+}
+
+// hookedFunc is a function replaced by hooked replacement.
+type hookedFunc struct {
+	name     string
+	funcType reflect.Type
+	original func() reflect.Value
+}
+
+func newHookedFunc(original any) (*hookedFunc, error) {
+	originalValue := reflect.ValueOf(original)
+	if originalValue.Kind() != reflect.Func {
+		return nil, ErrFunctionNotFound
+	}
+
+	originalName, ok := funcName(originalValue)
+	if !ok {
+		return nil, ErrFunctionNotFound
+	}
+
+	if !hookSupported() {
+		return nil, fmt.Errorf("%s: %w", originalName, ErrUnsupportedArchitecture)
+	}
+
+	return &hookedFunc{
+		name:     originalName,
+		funcType: originalValue.Type(),
+		original: sync.OnceValue(func() reflect.Value {
+			if hooked, ok := hookedOriginal(originalName, originalValue.Type()); ok {
+				return hooked
+			}
+
+			return originalValue
+		}),
+	}, nil
+}
+
+// call calls original function with provided arguments.
+func (h *hookedFunc) call(args []reflect.Value) []reflect.Value {
+	if h.funcType.IsVariadic() {
+		return h.original().CallSlice(args)
+	}
+
+	return h.original().Call(args)
+}
+
+// registerHooked registers replacement of hooked function. Replacement may call original function, see hookedFunc.call.
+func (p *Patcher) registerHooked(h *hookedFunc, replacement func(args []reflect.Value) []reflect.Value, reg registration) {
+	p.registerDispatched(h.name, dispatchedReplacement{
+		value: reflect.MakeFunc(h.funcType, replacement),
+		hook:  true,
+	}, reg)
+}
+
+// interfaces converts values to interfaces. Variadic arguments remain slice.
+func interfaces(values []reflect.Value) []any {
+	ret := make([]any, len(values))
+	for i, value := range values {
+		ret[i] = value.Interface()
+	}
+
+	return ret
+}
+
+// assignPads assigns regions of hookPad to hooked replacements and returns their addresses in executable.
+func (p *Patcher) assignPads(r *replacer.Replacer) (map[string]uint64, error) {
+	var originals []string
+	for original, replacement := range p.dispatched {
+		if replacement.hook {
+			originals = append(originals, original)
+		}
+	}
+
+	if len(originals) == 0 {
+		return nil, nil
+	}
+
+	if len(originals) > hookSlots {
+		return nil, fmt.Errorf("%w: %d replacements calling originals, maximum is %d",
+			ErrTooManyReplacements, len(originals), hookSlots)
+	}
+
+	name, _ := funcName(reflect.ValueOf(hookPad))
+
+	padEntry, err := r.Region(name, hookSlots*replacer.HookSize)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(originals)
+
+	pads := make(map[string]uint64, len(originals))
+	for i, original := range originals {
+		pads[original] = padEntry + uint64(i)*replacer.HookSize
+	}
+
+	return pads, nil
+}
+
+// hookedOriginal returns function of provided type calling original function of hooked replacement.
+// It reports false if replacement of original function was not applied to current executable.
+func hookedOriginal(original string, funcType reflect.Type) (reflect.Value, bool) {
+	if applied == nil {
+		return reflect.Value{}, false
+	}
+
+	gate, ok := applied.Gates[original]
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	// gate is placed relative to same anchor as dispatch table, see makeDispatchedReplacements
+	pc := uintptr(int64(reflect.ValueOf(NewPatcher).Pointer()) + gate)
+
+	// function value is a pointer to code pointer followed by captured variables
+	funcValue := &struct{ pc uintptr }{pc: pc}
+
+	fn := reflect.New(funcType)
+	*(*unsafe.Pointer)(fn.UnsafePointer()) = unsafe.Pointer(funcValue)
+
+	return fn.Elem(), true
+}
@@ -0,0 +1,17 @@
+#include "textflag.h"
+
+// hookPad is filled by int3 instructions, so unexpected jumps to it crash program.
+#define PAD8 BYTE $0xCC; BYTE $0xCC; BYTE $0xCC; BYTE $0xCC; BYTE $0xCC; BYTE $0xCC; BYTE $0xCC; BYTE $0xCC
+#define PAD64 PAD8; PAD8; PAD8; PAD8; PAD8; PAD8; PAD8; PAD8
+#define PAD512 PAD64; PAD64; PAD64; PAD64; PAD64; PAD64; PAD64; PAD64
+
+// func hookPad()
+TEXT ·hookPad(SB), NOSPLIT|NOFRAME, $0-0
+	PAD512
+	PAD512
+	PAD512
+	PAD512
+	PAD512
+	PAD512
+	PAD512
+	PAD512
@@ -0,0 +1,24 @@
+#include "textflag.h"
+
+// hookPad is filled by permanently undefined instructions, so unexpected jumps to it crash program.
+#define PAD8 WORD $0; WORD $0; WORD $0; WORD $0; WORD $0; WORD $0; WORD $0; WORD $0
+#define PAD64 PAD8; PAD8; PAD8; PAD8; PAD8; PAD8; PAD8; PAD8
+
+// func hookPad()
+TEXT ·hookPad(SB), NOSPLIT|NOFRAME, $0-0
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
+	PAD64
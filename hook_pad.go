@@ -0,0 +1,7 @@
+//go:build amd64 || arm64
+
+package monkey
+
+// hookPad is a region of executable code containing trampolines and gates of hooked replacements
+// (see replacer.Hook). Its size is hookSlots*replacer.HookSize bytes. It's never called.
+func hookPad()
@@ -0,0 +1,6 @@
+//go:build !amd64 && !arm64
+
+package monkey
+
+// hookPad is not used because hooked replacements are not supported on this architecture.
+func hookPad() {}
@@ -0,0 +1,145 @@
+package monkey
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInjectedFault returned by functions failed by policies passed to Inject.
+var ErrInjectedFault = fmt.Errorf("injected fault")
+
+// Policy decides whether call of function must fail. Policies must be safe for concurrent use.
+type Policy interface {
+	// Fail returns error returned by call with provided arguments instead of calling original function.
+	// For methods receiver is the first argument, variadic arguments passed as slice.
+	// Call of original function performed if nil returned. Arguments must not be retained after return
+	// because they may be placed on stack of caller.
+	Fail(args []any) error
+}
+
+// PolicyFunc is an adapter to use ordinary function as Policy.
+type PolicyFunc func(args []any) error
+
+func (f PolicyFunc) Fail(args []any) error { return f(args) }
+
+// Inject registers replacement of original function which returns error if policy decides so and calls
+// original function otherwise. Last result of original function must be error, other results are zero values
+// on failure. Replacement synthesized at runtime and calls original function, so this works only on some
+// architectures (currently amd64 and arm64), only for current executable and only for functions beginning with
+// usual prologue (ErrUnsupportedPrologue returned otherwise).
+//
+//	monkey.Inject(patcher, os.WriteFile, monkey.FailEveryN(3))
+//
+// Note that argument must be function despite "any" used as constraint. See RegisterReplacement for details.
+func Inject[T any](p *Patcher, original T, policy Policy, opts ...RegisterOption) {
+	reg := registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}
+
+	h, err := newHookedFunc(original)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+
+	if h.funcType.NumOut() == 0 || h.funcType.Out(h.funcType.NumOut()-1) != reflect.TypeOf((*error)(nil)).Elem() {
+		p.fail(fmt.Errorf("%s: %w: last result must be error", h.name, ErrResultsMismatch))
+		return
+	}
+
+	p.registerHooked(h, func(args []reflect.Value) []reflect.Value {
+		if err := policy.Fail(interfaces(args)); err != nil {
+			return faultResults(h.funcType, err)
+		}
+
+		return h.call(args)
+	}, reg)
+}
+
+func faultResults(funcType reflect.Type, err error) []reflect.Value {
+	results := zeroResults(funcType)
+	results[len(results)-1] = reflect.ValueOf(&err).Elem()
+
+	return results
+}
+
+func zeroResults(funcType reflect.Type) []reflect.Value {
+	results := make([]reflect.Value, funcType.NumOut())
+	for i := range results {
+		results[i] = reflect.Zero(funcType.Out(i))
+	}
+
+	return results
+}
+
+// FailEveryN returns policy failing every n-th call: n-th, 2n-th and so on.
+func FailEveryN(n int) Policy {
+	var calls atomic.Int64
+
+	return PolicyFunc(func([]any) error {
+		if n > 0 && calls.Add(1)%int64(n) == 0 {
+			return ErrInjectedFault
+		}
+
+		return nil
+	})
+}
+
+// FailAfter returns policy passing first n calls and failing all subsequent ones.
+func FailAfter(n int) Policy {
+	var calls atomic.Int64
+
+	return PolicyFunc(func([]any) error {
+		if calls.Add(1) > int64(n) {
+			return ErrInjectedFault
+		}
+
+		return nil
+	})
+}
+
+// FailWithProbability returns policy failing calls with provided probability in percents.
+// Decisions made by pseudo-random generator initialized by seed, so sequence of them is reproducible.
+func FailWithProbability(seed uint64, pct float64) Policy {
+	var (
+		mu        sync.Mutex
+		generator = rand.New(rand.NewPCG(seed, seed))
+	)
+
+	return PolicyFunc(func([]any) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if generator.Float64()*100 < pct {
+			return ErrInjectedFault
+		}
+
+		return nil
+	})
+}
+
+// FailOnArgs returns policy failing calls which arguments satisfy predicate. See Policy for arguments format.
+func FailOnArgs(pred func(args []any) bool) Policy {
+	return PolicyFunc(func(args []any) error {
+		if pred(args) {
+			return ErrInjectedFault
+		}
+
+		return nil
+	})
+}
+
+// FailWith returns policy failing same calls as provided one, but with provided error.
+func FailWith(policy Policy, err error) Policy {
+	return PolicyFunc(func(args []any) error {
+		if policy.Fail(args) != nil {
+			return err
+		}
+
+		return nil
+	})
+}
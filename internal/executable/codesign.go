@@ -0,0 +1,132 @@
+package executable
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Layouts of code signature structures are from xnu (osfmk/kern/cs_blobs.h), all fields are big-endian.
+const (
+	machoCodeSignatureCmd = 0x1d // LC_CODE_SIGNATURE
+
+	csMagicEmbeddedSignature = 0xfade0cc0
+	csMagicCodeDirectory     = 0xfade0c02
+
+	csHashTypeSHA1   = 1
+	csHashTypeSHA256 = 2
+
+	csSuperBlobSize     = 12
+	csBlobIndexSize     = 8
+	csCodeDirectorySize = 40 // fields up to page size which are needed to recompute hashes
+)
+
+// codeDirectory describes hashes of code pages in code signature. Linker makes ad-hoc signature consisting of
+// single code directory, other tools may add directories with other hash types.
+type codeDirectory struct {
+	hashesOffset int64 // file offset of hash of the first page
+	slots        uint32
+	codeLimit    uint32 // signed part of file
+	hashSize     uint8
+	pageBits     uint8
+	newHash      func() hash.Hash
+}
+
+// codeDirectories finds code directories in signature of Mach-O file. Nil returned for unsigned files.
+func codeDirectories(r io.ReaderAt, f *macho.File) ([]codeDirectory, error) {
+	var dataOff uint32
+
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		if len(raw) >= 16 && f.ByteOrder.Uint32(raw) == machoCodeSignatureCmd {
+			dataOff = f.ByteOrder.Uint32(raw[8:])
+			break
+		}
+	}
+
+	if dataOff == 0 {
+		return nil, nil
+	}
+
+	header := make([]byte, csSuperBlobSize)
+	if _, err := r.ReadAt(header, int64(dataOff)); err != nil {
+		return nil, fmt.Errorf("read code signature: %w", err)
+	}
+
+	if binary.BigEndian.Uint32(header) != csMagicEmbeddedSignature {
+		return nil, fmt.Errorf("unknown code signature magic %#x", binary.BigEndian.Uint32(header))
+	}
+
+	index := make([]byte, binary.BigEndian.Uint32(header[8:])*csBlobIndexSize)
+	if _, err := r.ReadAt(index, int64(dataOff)+csSuperBlobSize); err != nil {
+		return nil, fmt.Errorf("read code signature: %w", err)
+	}
+
+	var directories []codeDirectory
+
+	for i := 0; i < len(index); i += csBlobIndexSize {
+		blobOff := int64(dataOff) + int64(binary.BigEndian.Uint32(index[i+4:]))
+
+		blob := make([]byte, csCodeDirectorySize)
+		if _, err := r.ReadAt(blob, blobOff); err != nil {
+			return nil, fmt.Errorf("read code signature: %w", err)
+		}
+
+		if binary.BigEndian.Uint32(blob) != csMagicCodeDirectory {
+			continue // requirements, entitlements, CMS signature
+		}
+
+		directory := codeDirectory{
+			hashesOffset: blobOff + int64(binary.BigEndian.Uint32(blob[16:])),
+			slots:        binary.BigEndian.Uint32(blob[28:]),
+			codeLimit:    binary.BigEndian.Uint32(blob[32:]),
+			hashSize:     blob[36],
+			pageBits:     blob[39],
+		}
+
+		switch blob[37] {
+		case csHashTypeSHA1:
+			directory.newHash = sha1.New
+		case csHashTypeSHA256:
+			directory.newHash = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported code signature hash type %d", blob[37])
+		}
+
+		if directory.pageBits == 0 || int(directory.hashSize) > directory.newHash().Size() {
+			return nil, fmt.Errorf("unsupported code directory layout")
+		}
+
+		directories = append(directories, directory)
+	}
+
+	return directories, nil
+}
+
+// rehash recomputes hashes of pages overlapping with provided region of file.
+func (c *codeDirectory) rehash(rw ReadWriterAt, off, size int64) error {
+	pageSize := int64(1) << c.pageBits
+
+	page := make([]byte, pageSize)
+	for i := off >> c.pageBits; i <= (off+size-1)>>c.pageBits && i < int64(c.slots); i++ {
+		start := i << c.pageBits
+		end := min(start+pageSize, int64(c.codeLimit))
+
+		if _, err := rw.ReadAt(page[:end-start], start); err != nil {
+			return fmt.Errorf("read page %d: %w", i, err)
+		}
+
+		h := c.newHash()
+		h.Write(page[:end-start])
+
+		if _, err := rw.WriteAt(h.Sum(nil)[:c.hashSize], c.hashesOffset+i*int64(c.hashSize)); err != nil {
+			return fmt.Errorf("write hash of page %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package executable
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// checkSignature checks that hashes in code directories match content of file.
+func checkSignature(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	directories, err := codeDirectories(bytes.NewReader(data), f)
+	if err != nil {
+		t.Fatalf("Code directories: %s", err)
+	}
+
+	if len(directories) == 0 {
+		t.Fatalf("Fixture not signed")
+	}
+
+	for _, directory := range directories {
+		pageSize := 1 << directory.pageBits
+
+		for i := 0; i < int(directory.slots); i++ {
+			page := data[i*pageSize : min((i+1)*pageSize, int(directory.codeLimit))]
+			hash := directory.hashesOffset + int64(i)*int64(directory.hashSize)
+
+			if expected := sha256.Sum256(page); !bytes.Equal(data[hash:hash+int64(directory.hashSize)], expected[:]) {
+				t.Errorf("Hash of page %d mismatch", i)
+			}
+		}
+	}
+}
+
+func TestMachOCodeSignature(t *testing.T) {
+	// linker signs darwin/arm64 executables ad-hoc because kernel refuses to run unsigned ones
+	path := buildFixture(t, []string{"GOOS=darwin", "GOARCH=arm64", "CGO_ENABLED=0"})
+
+	checkSignature(t, path)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	e, err := NewMachO(file)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	r, err := replacer.NewReplacer(e)
+	if err != nil {
+		t.Fatalf("Replacer: %s", err)
+	}
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	if err = r.Replace("main.answer", "main.otherAnswer"); err != nil {
+		t.Fatalf("Replace: %s", err)
+	}
+
+	_ = file.Close()
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	if bytes.Equal(before, after) {
+		t.Fatalf("Fixture not patched")
+	}
+
+	checkSignature(t, path)
+}
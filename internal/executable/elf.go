@@ -1,11 +1,15 @@
 package executable
 
 import (
+	"bytes"
 	"debug/elf"
 	"debug/gosym"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+
+	"github.com/xakep666/monkey/internal/replacer"
 )
 
 const (
@@ -14,12 +18,20 @@ const (
 	elfGoPCLnTab = ".gopclntab"
 )
 
+// elfSegmentAlign is an alignment used for appended segments. It's large enough for all supported page sizes.
+const elfSegmentAlign = 0x10000
+
 type ELF struct {
-	io.WriterAt
+	ReadWriterAt
 
-	goarch                string
-	load                  *elf.Prog
-	text, symTab, pcLnTab *elf.Section
+	reader          io.ReaderAt
+	goarch          string
+	file            *elf.File
+	loads           []elf.ProgHeader
+	textAddr        uint64
+	textRanges      []replacer.Range
+	symTab, pcLnTab *io.SectionReader
+	codeAppended    bool
 }
 
 func NewELF(rw ReadWriterAt) (*ELF, error) {
@@ -28,20 +40,28 @@ func NewELF(rw ReadWriterAt) (*ELF, error) {
 		return nil, fmt.Errorf("elf open: %w", err)
 	}
 
-	var loadProg *elf.Prog
+	var loads []elf.ProgHeader
 	for _, prog := range elfFile.Progs {
 		if prog.Type == elf.PT_LOAD {
-			loadProg = prog
-			break
+			loads = append(loads, prog.ProgHeader)
 		}
 	}
 
-	if loadProg == nil {
+	if len(loads) == 0 {
 		return nil, ErrNotGo("LOAD program not found")
 	}
 
-	var text, symTab, pcLnTab *elf.Section
+	var (
+		text, symTab, pcLnTab *elf.Section
+		textRanges            []replacer.Range
+	)
+
 	for _, section := range elfFile.Sections {
+		if section.Name == elfText {
+			// linker splits large text to several sections with same name
+			textRanges = append(textRanges, replacer.Range{Start: section.Addr, End: section.Addr + section.Size})
+		}
+
 		switch {
 		case text == nil && section.Name == elfText:
 			text = section
@@ -52,37 +72,257 @@ func NewELF(rw ReadWriterAt) (*ELF, error) {
 		}
 	}
 
-	if text == nil || symTab == nil || pcLnTab == nil {
-		return nil, ErrNotGo("go-specific sections not found")
+	ret := &ELF{
+		ReadWriterAt: rw,
+
+		reader:     rw,
+		file:       elfFile,
+		loads:      loads,
+		textRanges: textRanges,
+		symTab:     io.NewSectionReader(rw, 0, 0), // symtab is empty since go1.3, so linker may omit it
+	}
+
+	if symTab != nil {
+		ret.symTab = io.NewSectionReader(symTab, 0, int64(symTab.Size))
 	}
 
-	goarch := getGOARCH(rw)
-	if goarch == "" {
-		if goarch = elfGOARCH(elfFile); goarch == "" {
+	if text != nil && pcLnTab != nil {
+		ret.textAddr = text.Addr
+		ret.pcLnTab = io.NewSectionReader(pcLnTab, 0, int64(pcLnTab.Size))
+
+		// external linker may place C code (i.e. _init of shared objects) before go code,
+		// addresses in pclntab are relative to runtime.text
+		if goText, ok := elfSymbol(elfFile, "runtime.text"); ok && goText > text.Addr && goText < text.Addr+text.Size {
+			ret.textAddr = goText
+			ret.textRanges[0].Start = goText
+		}
+	} else {
+		// section headers stripped or pclntab placed to other section
+		segments := make([]loadSegment, len(loads))
+		for i, load := range loads {
+			segments[i] = loadSegment{addr: load.Vaddr, offset: load.Off, size: load.Filesz}
+		}
+
+		scanned, err := scanPCLnTab(rw, segments, elfFile.ByteOrder)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.textAddr = scanned.text
+		ret.pcLnTab = scanned.data
+
+		if text == nil {
+			ret.textRanges = []replacer.Range{{Start: scanned.text, End: scanned.etext}}
+		}
+	}
+
+	if ret.goarch = getGOARCH(rw); ret.goarch == "" {
+		if ret.goarch = elfGOARCH(elfFile); ret.goarch == "" {
 			return nil, ErrNotGo("can't detect goarch")
 		}
 	}
 
-	return &ELF{
-		WriterAt: rw,
+	return ret, nil
+}
+
+func (e *ELF) GOARCH() string { return e.goarch }
+
+func (e *ELF) TextAddr() uint64 { return e.textAddr }
+
+func (e *ELF) TextRanges() []replacer.Range { return e.textRanges }
+
+func (e *ELF) GoSymTabData() io.Reader { return io.NewSectionReader(e.symTab, 0, e.symTab.Size()) }
+
+func (e *ELF) GoPCLnTabData() io.Reader { return io.NewSectionReader(e.pcLnTab, 0, e.pcLnTab.Size()) }
+
+// Offset finds loadable segment containing function and calculates offset using it.
+func (e *ELF) Offset(p *gosym.Func) (int64, error) { return elfOffset(e.loads, p.Entry) }
+
+func elfOffset(loads []elf.ProgHeader, addr uint64) (int64, error) {
+	for _, load := range loads {
+		if addr >= load.Vaddr && addr < load.Vaddr+load.Filesz {
+			return int64(addr - load.Vaddr + load.Off), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %#x", ErrNotMapped, addr)
+}
+
+// AppendCode places code at the end of file and describes it by new loadable segment.
+// There is no room for new entry in program header table, so entry of PT_NOTE segment reused for this.
+// Notes itself stay in file, but loader will not see them. It may be done only once.
+func (e *ELF) AppendCode(code []byte) (uint64, error) {
+	if e.codeAppended {
+		return 0, fmt.Errorf("code already appended")
+	}
+
+	progs := e.file.Progs
+
+	noteIdx := -1
+	for i, prog := range progs {
+		if prog.Type == elf.PT_NOTE {
+			noteIdx = i
+		}
+	}
+
+	if noteIdx < 0 {
+		return 0, fmt.Errorf("no PT_NOTE segment to reuse")
+	}
+
+	tables, err := e.tables()
+	if err != nil {
+		return 0, err
+	}
+
+	var fileEnd, memEnd uint64
+	for _, prog := range progs {
+		fileEnd = max64(fileEnd, prog.Off+prog.Filesz)
+		if prog.Type == elf.PT_LOAD {
+			memEnd = max64(memEnd, prog.Vaddr+prog.Memsz)
+		}
+	}
+
+	for _, section := range e.file.Sections {
+		if section.Type != elf.SHT_NOBITS {
+			fileEnd = max64(fileEnd, section.Offset+section.FileSize)
+		}
+	}
+
+	fileEnd = max64(fileEnd, tables.shOff+tables.shEntSize*tables.shNum)
+
+	segment := elf.ProgHeader{
+		Type:   elf.PT_LOAD,
+		Flags:  elf.PF_R | elf.PF_X,
+		Off:    alignUp(fileEnd, elfSegmentAlign),
+		Vaddr:  alignUp(memEnd, elfSegmentAlign),
+		Filesz: uint64(len(code)),
+		Memsz:  uint64(len(code)),
+		Align:  elfSegmentAlign,
+	}
+	segment.Paddr = segment.Vaddr
+
+	if _, err = e.WriteAt(code, int64(segment.Off)); err != nil {
+		return 0, fmt.Errorf("write code: %w", err)
+	}
+
+	// loadable segments must be sorted by virtual address, so put new one after last loadable segment
+	headers := make([]elf.ProgHeader, 0, len(progs))
+	for i, prog := range progs {
+		if i != noteIdx {
+			headers = append(headers, prog.ProgHeader)
+		}
+	}
+
+	insertIdx := len(headers)
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].Type == elf.PT_LOAD {
+			insertIdx = i + 1
+			break
+		}
+	}
+
+	headers = append(headers[:insertIdx], append([]elf.ProgHeader{segment}, headers[insertIdx:]...)...)
+
+	for i, header := range headers {
+		if _, err = e.WriteAt(e.encodeProgHeader(&header), int64(tables.phOff+uint64(i)*tables.phEntSize)); err != nil {
+			return 0, fmt.Errorf("write program header: %w", err)
+		}
+	}
+
+	e.loads = append(e.loads, segment)
+	e.codeAppended = true
 
-		goarch:  goarch,
-		load:    loadProg,
-		text:    text,
-		symTab:  symTab,
-		pcLnTab: pcLnTab,
-	}, nil
+	return segment.Vaddr, nil
 }
 
-func (elf *ELF) GOARCH() string { return elf.goarch }
+// elfTables contains locations of header tables from file header.
+type elfTables struct {
+	phOff, shOff         uint64
+	phEntSize, shEntSize uint64
+	shNum                uint64
+}
 
-func (elf *ELF) TextAddr() uint64 { return elf.text.Addr }
+func (e *ELF) tables() (elfTables, error) {
+	r := io.NewSectionReader(e.reader, 0, math.MaxInt64)
 
-func (elf *ELF) GoSymTabData() io.Reader { return elf.symTab.Open() }
+	switch e.file.Class {
+	case elf.ELFCLASS32:
+		var hdr elf.Header32
+		if err := binary.Read(r, e.file.ByteOrder, &hdr); err != nil {
+			return elfTables{}, fmt.Errorf("read elf header: %w", err)
+		}
 
-func (elf *ELF) GoPCLnTabData() io.Reader { return elf.pcLnTab.Open() }
+		return elfTables{
+			phOff:     uint64(hdr.Phoff),
+			shOff:     uint64(hdr.Shoff),
+			phEntSize: uint64(hdr.Phentsize),
+			shEntSize: uint64(hdr.Shentsize),
+			shNum:     uint64(hdr.Shnum),
+		}, nil
+	case elf.ELFCLASS64:
+		var hdr elf.Header64
+		if err := binary.Read(r, e.file.ByteOrder, &hdr); err != nil {
+			return elfTables{}, fmt.Errorf("read elf header: %w", err)
+		}
 
-func (elf *ELF) Offset(p *gosym.Func) int64 { return int64(p.Entry - elf.load.Vaddr) }
+		return elfTables{
+			phOff:     hdr.Phoff,
+			shOff:     hdr.Shoff,
+			phEntSize: uint64(hdr.Phentsize),
+			shEntSize: uint64(hdr.Shentsize),
+			shNum:     uint64(hdr.Shnum),
+		}, nil
+	default:
+		return elfTables{}, fmt.Errorf("unknown elf class %s", e.file.Class)
+	}
+}
+
+func (e *ELF) encodeProgHeader(p *elf.ProgHeader) []byte {
+	var buf bytes.Buffer
+
+	switch e.file.Class {
+	case elf.ELFCLASS32:
+		_ = binary.Write(&buf, e.file.ByteOrder, elf.Prog32{
+			Type:   uint32(p.Type),
+			Off:    uint32(p.Off),
+			Vaddr:  uint32(p.Vaddr),
+			Paddr:  uint32(p.Paddr),
+			Filesz: uint32(p.Filesz),
+			Memsz:  uint32(p.Memsz),
+			Flags:  uint32(p.Flags),
+			Align:  uint32(p.Align),
+		})
+	default:
+		_ = binary.Write(&buf, e.file.ByteOrder, elf.Prog64{
+			Type:   uint32(p.Type),
+			Flags:  uint32(p.Flags),
+			Off:    p.Off,
+			Vaddr:  p.Vaddr,
+			Paddr:  p.Paddr,
+			Filesz: p.Filesz,
+			Memsz:  p.Memsz,
+			Align:  p.Align,
+		})
+	}
+
+	return buf.Bytes()
+}
+
+// elfSymbol returns value of symbol from symbol table if it's present.
+func elfSymbol(f *elf.File, name string) (uint64, bool) {
+	symbols, err := f.Symbols()
+	if err != nil {
+		return 0, false
+	}
+
+	for _, symbol := range symbols {
+		if symbol.Name == name {
+			return symbol.Value, true
+		}
+	}
+
+	return 0, false
+}
 
 func elfGOARCH(f *elf.File) string {
 	switch f.Machine {
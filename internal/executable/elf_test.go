@@ -0,0 +1,120 @@
+package executable
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestELFOffset(t *testing.T) {
+	for name, tc := range map[string]struct {
+		flags    []string
+		external bool
+	}{
+		"internal":      {flags: []string{"-ldflags=-linkmode=internal"}},
+		"external":      {flags: []string{"-ldflags=-linkmode=external"}, external: true},
+		"separate code": {flags: []string{"-ldflags=-linkmode=external -extldflags=-Wl,-z,separate-code"}, external: true},
+		"pie":           {flags: []string{"-buildmode=pie"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := []string{"GOOS=linux", "CGO_ENABLED=0"}
+			if tc.external {
+				if _, err := exec.LookPath("cc"); err != nil || runtime.GOOS != "linux" {
+					t.Skip("external linker not available")
+				}
+
+				env = []string{"CGO_ENABLED=1"}
+			}
+
+			file, err := os.Open(buildFixture(t, env, tc.flags...))
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			defer file.Close()
+
+			f, err := elf.NewFile(file)
+			if err != nil {
+				t.Fatalf("Parse fixture: %s", err)
+			}
+
+			var loads []elf.ProgHeader
+			for _, prog := range f.Progs {
+				if prog.Type == elf.PT_LOAD {
+					loads = append(loads, prog.ProgHeader)
+				}
+			}
+
+			symbols, err := f.Symbols()
+			if err != nil {
+				t.Fatalf("Symbols: %s", err)
+			}
+
+			text := f.Section(".text")
+
+			var checked int
+			for _, symbol := range symbols {
+				if symbol.Name != "main.answer" && symbol.Name != "main.otherAnswer" {
+					continue
+				}
+
+				offset, err := elfOffset(loads, symbol.Value)
+				if err != nil {
+					t.Fatalf("Offset of %s: %s", symbol.Name, err)
+				}
+
+				// section headers describe same mapping in other way
+				code, expected := make([]byte, 16), make([]byte, 16)
+				if _, err = text.ReadAt(expected, int64(symbol.Value-text.Addr)); err != nil {
+					t.Fatalf("Read section: %s", err)
+				}
+
+				if _, err = file.ReadAt(code, offset); err != nil {
+					t.Fatalf("Read file: %s", err)
+				}
+
+				if !bytes.Equal(code, expected) {
+					t.Errorf("Unexpected code of %s at offset %#x: %x, expected %x", symbol.Name, offset, code, expected)
+				}
+
+				checked++
+			}
+
+			if checked != 2 {
+				t.Errorf("Functions not found in symbol table")
+			}
+
+			if _, err := elfOffset(loads, math.MaxUint64); !errors.Is(err, ErrNotMapped) {
+				t.Errorf("Unexpected error for unmapped address: %v", err)
+			}
+		})
+	}
+}
+
+func TestELFOffsetSegments(t *testing.T) {
+	// lld places segments without keeping same difference between addresses and offsets
+	loads := []elf.ProgHeader{
+		{Type: elf.PT_LOAD, Off: 0, Vaddr: 0x200000, Filesz: 0x1234},
+		{Type: elf.PT_LOAD, Off: 0x1240, Vaddr: 0x202240, Filesz: 0x5000},
+	}
+
+	for addr, expected := range map[uint64]int64{
+		0x200010: 0x10,
+		0x202240: 0x1240,
+		0x203000: 0x2000,
+	} {
+		if offset, err := elfOffset(loads, addr); err != nil || offset != expected {
+			t.Errorf("Unexpected offset of %#x: %#x, %v", addr, offset, err)
+		}
+	}
+
+	// gap between segments
+	if _, err := elfOffset(loads, 0x201f00); !errors.Is(err, ErrNotMapped) {
+		t.Errorf("Unexpected error for unmapped address: %v", err)
+	}
+}
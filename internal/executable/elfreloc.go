@@ -0,0 +1,164 @@
+package executable
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// Tags of packed relative relocations, debug/elf doesn't define them.
+const (
+	elfDTRelrSize = 35 // DT_RELRSZ
+	elfDTRelr     = 36 // DT_RELR
+	elfDTRelrEnt  = 37 // DT_RELRENT
+)
+
+// Relocations returns places modified by loader according to relocation tables referred by dynamic segment.
+// Segment is used instead of sections because section headers may be stripped.
+// Each relocation assumed to modify pointer-sized word.
+func (e *ELF) Relocations() ([]replacer.Range, error) {
+	var dynamic *elf.Prog
+	for _, prog := range e.file.Progs {
+		if prog.Type == elf.PT_DYNAMIC {
+			dynamic = prog
+			break
+		}
+	}
+
+	if dynamic == nil {
+		return nil, nil // statically linked non-PIE executable
+	}
+
+	tags, err := e.dynamicTags(dynamic)
+	if err != nil {
+		return nil, fmt.Errorf("read dynamic segment: %w", err)
+	}
+
+	wordSize := uint64(8)
+	if e.file.Class == elf.ELFCLASS32 {
+		wordSize = 4
+	}
+
+	var relocations []replacer.Range
+
+	for _, table := range []struct {
+		addr, size elf.DynTag
+	}{
+		{addr: elf.DT_RELA, size: elf.DT_RELASZ},
+		{addr: elf.DT_REL, size: elf.DT_RELSZ},
+		{addr: elf.DT_JMPREL, size: elf.DT_PLTRELSZ},
+	} {
+		addr, size := tags[table.addr], tags[table.size]
+		if addr == 0 || size == 0 {
+			continue
+		}
+
+		rela := table.addr == elf.DT_RELA
+		if table.addr == elf.DT_JMPREL {
+			// PLT relocations have format specified by DT_PLTREL
+			rela = elf.DynTag(tags[elf.DT_PLTREL]) == elf.DT_RELA
+		}
+
+		// sizes of Elf_Rel/Elf_Rela used if not specified
+		entSize := tags[elf.DT_RELENT]
+		if entSize == 0 {
+			entSize = 2 * wordSize
+		}
+
+		if rela {
+			if entSize = tags[elf.DT_RELAENT]; entSize == 0 {
+				entSize = 3 * wordSize
+			}
+		}
+
+		data, err := e.readAddr(addr, size)
+		if err != nil {
+			return nil, fmt.Errorf("read %s table: %w", table.addr, err)
+		}
+
+		// r_offset is the first field of both Elf_Rel and Elf_Rela
+		for i := uint64(0); i+wordSize <= size; i += entSize {
+			offset := e.word(data[i:], wordSize)
+			relocations = append(relocations, replacer.Range{Start: offset, End: offset + wordSize})
+		}
+	}
+
+	if addr, size := tags[elfDTRelr], tags[elfDTRelrSize]; addr != 0 && size != 0 {
+		data, err := e.readAddr(addr, size)
+		if err != nil {
+			return nil, fmt.Errorf("read DT_RELR table: %w", err)
+		}
+
+		// address entry followed by bitmaps of relocated words after it, least significant bit marks bitmap
+		var next uint64
+		for i := uint64(0); i+wordSize <= size; i += wordSize {
+			entry := e.word(data[i:], wordSize)
+			if entry&1 == 0 {
+				relocations = append(relocations, replacer.Range{Start: entry, End: entry + wordSize})
+				next = entry + wordSize
+				continue
+			}
+
+			for bit := uint64(1); bit < wordSize*8; bit++ {
+				if entry&(1<<bit) != 0 {
+					addr := next + (bit-1)*wordSize
+					relocations = append(relocations, replacer.Range{Start: addr, End: addr + wordSize})
+				}
+			}
+
+			next += (wordSize*8 - 1) * wordSize
+		}
+	}
+
+	return relocations, nil
+}
+
+// dynamicTags returns values of tags from dynamic segment.
+func (e *ELF) dynamicTags(dynamic *elf.Prog) (map[elf.DynTag]uint64, error) {
+	data, err := io.ReadAll(dynamic.Open())
+	if err != nil {
+		return nil, err
+	}
+
+	wordSize := 8
+	if e.file.Class == elf.ELFCLASS32 {
+		wordSize = 4
+	}
+
+	tags := make(map[elf.DynTag]uint64)
+	for i := 0; i+2*wordSize <= len(data); i += 2 * wordSize {
+		tag := elf.DynTag(e.word(data[i:], uint64(wordSize)))
+		if tag == elf.DT_NULL {
+			break
+		}
+
+		tags[tag] = e.word(data[i+wordSize:], uint64(wordSize))
+	}
+
+	return tags, nil
+}
+
+// readAddr reads data located at virtual address.
+func (e *ELF) readAddr(addr, size uint64) ([]byte, error) {
+	offset, err := elfOffset(e.loads, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err = e.reader.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (e *ELF) word(b []byte, size uint64) uint64 {
+	if size == 4 {
+		return uint64(e.file.ByteOrder.Uint32(b))
+	}
+
+	return e.file.ByteOrder.Uint64(b)
+}
@@ -0,0 +1,76 @@
+package executable
+
+import (
+	"debug/macho"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// FatMachO is a universal binary containing Mach-O executables for several architectures.
+type FatMachO struct {
+	Slices []*MachO
+}
+
+// NewFatMachO opens all slices of universal binary made by lipo.
+// Offsets inside of slices are translated to positions in outer file.
+func NewFatMachO(rw ReadWriterAt) (*FatMachO, error) {
+	fatFile, err := macho.NewFatFile(rw)
+	if err != nil {
+		return nil, fmt.Errorf("macho fat open: %w", err)
+	}
+
+	ret := &FatMachO{Slices: make([]*MachO, 0, len(fatFile.Arches))}
+
+	for _, arch := range fatFile.Arches {
+		slice, err := NewMachO(&fatSlice{
+			SectionReader: io.NewSectionReader(rw, int64(arch.Offset), int64(arch.Size)),
+			w:             rw,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("slice %s: %w", arch.Cpu, err)
+		}
+
+		ret.Slices = append(ret.Slices, slice)
+	}
+
+	return ret, nil
+}
+
+// Slice returns executable for provided architecture.
+func (f *FatMachO) Slice(goarch string) (*MachO, bool) {
+	for _, slice := range f.Slices {
+		if slice.GOARCH() == goarch {
+			return slice, true
+		}
+	}
+
+	return nil, false
+}
+
+// Current returns executable for architecture of running program.
+func (f *FatMachO) Current() (*MachO, error) {
+	slice, ok := f.Slice(runtime.GOARCH)
+	if !ok {
+		return nil, ErrNotGo("no slice for " + runtime.GOARCH)
+	}
+
+	return slice, nil
+}
+
+// fatSlice is a part of universal binary containing executable for single architecture.
+type fatSlice struct {
+	*io.SectionReader
+
+	w io.WriterAt
+}
+
+func (s *fatSlice) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.Size() {
+		return 0, fmt.Errorf("write at %#x: outside of slice", off)
+	}
+
+	_, base, _ := s.Outer()
+
+	return s.w.WriteAt(p, base+off)
+}
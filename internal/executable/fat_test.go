@@ -0,0 +1,147 @@
+package executable
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// fatAlign is an alignment of slices used by lipo (log2).
+const fatAlign = 14
+
+// makeFat makes universal binary like lipo does.
+func makeFat(t *testing.T, paths ...string) (string, []macho.FatArchHeader) {
+	t.Helper()
+
+	headers := make([]macho.FatArchHeader, len(paths))
+	data := make([][]byte, len(paths))
+	offset := uint32(1 << fatAlign)
+
+	for i, path := range paths {
+		f, err := macho.Open(path)
+		if err != nil {
+			t.Fatalf("Open slice: %s", err)
+		}
+
+		headers[i] = macho.FatArchHeader{Cpu: f.Cpu, SubCpu: f.SubCpu, Offset: offset, Align: fatAlign}
+		_ = f.Close()
+
+		if data[i], err = os.ReadFile(path); err != nil {
+			t.Fatalf("Read slice: %s", err)
+		}
+
+		headers[i].Size = uint32(len(data[i]))
+		offset += uint32(alignUp(uint64(len(data[i])), 1<<fatAlign))
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, [2]uint32{macho.MagicFat, uint32(len(paths))})
+	_ = binary.Write(&buf, binary.BigEndian, headers)
+
+	for i := range data {
+		buf.Write(make([]byte, int(headers[i].Offset)-buf.Len()))
+		buf.Write(data[i])
+	}
+
+	path := filepath.Join(t.TempDir(), "fat")
+	if err := os.WriteFile(path, buf.Bytes(), 0o755); err != nil {
+		t.Fatalf("Write fat: %s", err)
+	}
+
+	return path, headers
+}
+
+// patchSlice replaces main.answer in executable.
+func patchSlice(t *testing.T, e replacer.Executable) {
+	t.Helper()
+
+	r, err := replacer.NewReplacer(e)
+	if err != nil {
+		t.Fatalf("Replacer: %s", err)
+	}
+
+	if err = r.Replace("main.answer", "main.otherAnswer"); err != nil {
+		t.Fatalf("Replace: %s", err)
+	}
+}
+
+func TestFatMachO(t *testing.T) {
+	var paths []string
+	for _, goarch := range []string{"amd64", "arm64"} {
+		paths = append(paths, buildFixture(t, []string{"GOOS=darwin", "GOARCH=" + goarch, "CGO_ENABLED=0"}))
+	}
+
+	path, headers := makeFat(t, paths...)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open fat: %s", err)
+	}
+
+	defer file.Close()
+
+	if current, err := Recognize(file); err != nil {
+		if runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" {
+			t.Errorf("Recognize: %s", err)
+		}
+	} else if current.GOARCH() != runtime.GOARCH {
+		t.Errorf("Unexpected slice recognized: %s", current.GOARCH())
+	}
+
+	exes, err := RecognizeAll(file)
+	if err != nil {
+		t.Fatalf("Recognize all: %s", err)
+	}
+
+	if len(exes) != len(paths) {
+		t.Fatalf("Unexpected slices count: %d", len(exes))
+	}
+
+	for _, e := range exes {
+		patchSlice(t, e)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fat: %s", err)
+	}
+
+	// slices must be patched same way as thin executables
+	for i, slicePath := range paths {
+		f, err := os.OpenFile(slicePath, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("Open slice: %s", err)
+		}
+
+		e, err := NewMachO(f)
+		if err != nil {
+			t.Fatalf("Open slice: %s", err)
+		}
+
+		if e.GOARCH() != exes[i].GOARCH() {
+			t.Fatalf("Unexpected slice order: %s", exes[i].GOARCH())
+		}
+
+		patchSlice(t, e)
+		_ = f.Close()
+
+		thin, err := os.ReadFile(slicePath)
+		if err != nil {
+			t.Fatalf("Read slice: %s", err)
+		}
+
+		if !bytes.Equal(data[headers[i].Offset:headers[i].Offset+headers[i].Size], thin) {
+			t.Errorf("Slice %s patched differently", e.GOARCH())
+		}
+
+		if e.GOARCH() == "arm64" {
+			checkSignature(t, slicePath)
+		}
+	}
+}
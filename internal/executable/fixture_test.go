@@ -0,0 +1,49 @@
+package executable
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const fixtureSource = `package main
+
+//go:noinline
+func answer() int { return 1 }
+
+//go:noinline
+func otherAnswer() int { return 2 }
+
+func main() { println(answer(), otherAnswer()) }
+`
+
+// buildFixture compiles small program with provided environment and build flags.
+func buildFixture(t *testing.T, env []string, flags ...string) string {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":  "module fixture\n\ngo 1.22\n",
+		"main.go": fixtureSource,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("Write fixture source: %s", err)
+		}
+	}
+
+	cmd := exec.Command(goBin, append(append([]string{"build", "-o", "fixture"}, flags...), ".")...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GOFLAGS="), env...)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Build fixture: %s\n%s", err, out)
+	}
+
+	return filepath.Join(dir, "fixture")
+}
@@ -5,6 +5,8 @@ import (
 	"debug/macho"
 	"fmt"
 	"io"
+
+	"github.com/xakep666/monkey/internal/replacer"
 )
 
 const (
@@ -14,12 +16,17 @@ const (
 	machoGoPCLnTab   = "__gopclntab"
 )
 
+// MachO doesn't implement replacer.Relocator: rebase opcodes and chained fixups are not parsed,
+// so code modified by loader (possible only for foreign code linked into executable) is not detected.
 type MachO struct {
-	io.WriterAt
-
-	goarch                string
-	lcSegment             *macho.Segment
-	text, symTab, pcLnTab *macho.Section
+	ReadWriterAt
+
+	goarch          string
+	lcSegment       *macho.Segment
+	textAddr        uint64
+	textRanges      []replacer.Range
+	symTab, pcLnTab *io.SectionReader
+	codeDirectories []codeDirectory
 }
 
 func NewMachO(rw ReadWriterAt) (*MachO, error) {
@@ -33,8 +40,17 @@ func NewMachO(rw ReadWriterAt) (*MachO, error) {
 		return nil, ErrNotGo("loader segment for __text not found")
 	}
 
-	var text, symTab, pcLnTab *macho.Section
+	var (
+		text, symTab, pcLnTab *macho.Section
+		textRanges            []replacer.Range
+	)
+
 	for _, section := range machoFile.Sections {
+		if section.Name == machoText && section.Seg == machoTextSegment {
+			// linker splits large text to several sections with same name
+			textRanges = append(textRanges, replacer.Range{Start: section.Addr, End: section.Addr + section.Size})
+		}
+
 		switch {
 		case text == nil && section.Name == machoText:
 			text = section
@@ -45,38 +61,90 @@ func NewMachO(rw ReadWriterAt) (*MachO, error) {
 		}
 	}
 
-	if text == nil || symTab == nil || pcLnTab == nil {
-		return nil, ErrNotGo("go-specific sections not found")
+	ret := &MachO{
+		ReadWriterAt: rw,
+
+		lcSegment:  lcSegment,
+		textRanges: textRanges,
+		symTab:     io.NewSectionReader(rw, 0, 0), // symtab is empty since go1.3, so linker may omit it
 	}
 
-	goarch := getGOARCH(rw)
-	if goarch == "" {
-		if goarch = machoGOARCH(machoFile); goarch == "" {
-			return nil, ErrNotGo("can't detect goarch")
+	if symTab != nil {
+		ret.symTab = io.NewSectionReader(symTab, 0, int64(symTab.Size))
+	}
+
+	if text != nil && pcLnTab != nil {
+		ret.textAddr = text.Addr
+		ret.pcLnTab = io.NewSectionReader(pcLnTab, 0, int64(pcLnTab.Size))
+	} else {
+		// pclntab placed to section with other name
+		var segments []loadSegment
+		for _, load := range machoFile.Loads {
+			if segment, ok := load.(*macho.Segment); ok && segment.Filesz > 0 {
+				segments = append(segments, loadSegment{addr: segment.Addr, offset: segment.Offset, size: segment.Filesz})
+			}
+		}
+
+		scanned, err := scanPCLnTab(rw, segments, machoFile.ByteOrder)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.textAddr = scanned.text
+		ret.pcLnTab = scanned.data
+
+		if text == nil {
+			ret.textRanges = []replacer.Range{{Start: scanned.text, End: scanned.etext}}
 		}
 	}
 
-	return &MachO{
-		WriterAt: rw,
+	if ret.codeDirectories, err = codeDirectories(rw, machoFile); err != nil {
+		return nil, err
+	}
 
-		goarch:    goarch,
-		lcSegment: lcSegment,
-		text:      text,
-		symTab:    symTab,
-		pcLnTab:   pcLnTab,
-	}, nil
+	if ret.goarch = getGOARCH(rw); ret.goarch == "" {
+		if ret.goarch = machoGOARCH(machoFile); ret.goarch == "" {
+			return nil, ErrNotGo("can't detect goarch")
+		}
+	}
+
+	return ret, nil
 }
 
 func (m *MachO) GOARCH() string { return m.goarch }
 
-func (m *MachO) TextAddr() uint64 { return m.text.Addr }
+func (m *MachO) TextAddr() uint64 { return m.textAddr }
+
+func (m *MachO) TextRanges() []replacer.Range { return m.textRanges }
+
+func (m *MachO) GoSymTabData() io.Reader { return io.NewSectionReader(m.symTab, 0, m.symTab.Size()) }
+
+func (m *MachO) GoPCLnTabData() io.Reader { return io.NewSectionReader(m.pcLnTab, 0, m.pcLnTab.Size()) }
 
-func (m *MachO) GoSymTabData() io.Reader { return m.symTab.Open() }
+// WriteAt writes to file and updates ad-hoc code signature (if present) because on some platforms
+// (i.e. darwin/arm64) executables with invalid signature are killed.
+// Signatures made using certificates become invalid anyway.
+func (m *MachO) WriteAt(p []byte, off int64) (int, error) {
+	n, err := m.ReadWriterAt.WriteAt(p, off)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	for i := range m.codeDirectories {
+		if err = m.codeDirectories[i].rehash(m.ReadWriterAt, off, int64(n)); err != nil {
+			return n, fmt.Errorf("update code signature: %w", err)
+		}
+	}
 
-func (m *MachO) GoPCLnTabData() io.Reader { return m.pcLnTab.Open() }
+	return n, nil
+}
+
+func (m *MachO) Offset(p *gosym.Func) (int64, error) {
+	if p.Entry < m.lcSegment.Addr || p.Entry >= m.lcSegment.Addr+m.lcSegment.Filesz {
+		return 0, fmt.Errorf("%w: %#x", ErrNotMapped, p.Entry)
+	}
 
-func (m *MachO) Offset(p *gosym.Func) int64 {
-	return int64(p.Entry - m.lcSegment.Addr + m.lcSegment.Offset)
+	return int64(p.Entry - m.lcSegment.Addr + m.lcSegment.Offset), nil
 }
 
 func machoGOARCH(m *macho.File) string {
@@ -0,0 +1,158 @@
+package executable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Magic numbers at the beginning of pclntab written by different go versions.
+const (
+	pcLnTabMagic12  = 0xfffffffb
+	pcLnTabMagic116 = 0xfffffffa
+	pcLnTabMagic118 = 0xfffffff0
+	pcLnTabMagic120 = 0xfffffff1
+)
+
+// loadSegment is a part of loadable segment present in file.
+type loadSegment struct {
+	addr, offset, size uint64
+}
+
+// scannedPCLnTab is a pclntab found in loadable segments.
+type scannedPCLnTab struct {
+	data        *io.SectionReader
+	text, etext uint64
+}
+
+// scanPCLnTab finds pclntab by magic number in loadable segments. It's used when section headers are stripped
+// or pclntab placed to section with other name. Candidate confirmed if runtime.firstmoduledata found:
+// its first field points to pclntab and second one is a slice inside it. Addresses of text also taken from there.
+func scanPCLnTab(r io.ReaderAt, segments []loadSegment, order binary.ByteOrder) (*scannedPCLnTab, error) {
+	data := make([][]byte, len(segments))
+	for i, segment := range segments {
+		data[i] = make([]byte, segment.size)
+		if _, err := r.ReadAt(data[i], int64(segment.offset)); err != nil {
+			return nil, fmt.Errorf("read segment at %#x: %w", segment.addr, err)
+		}
+	}
+
+	for i, segment := range segments {
+		for _, magic := range []uint32{pcLnTabMagic120, pcLnTabMagic118, pcLnTabMagic116, pcLnTabMagic12} {
+			pattern := make([]byte, 6) // magic and zero padding
+			order.PutUint32(pattern, magic)
+
+			for pos := 0; ; pos++ {
+				idx := bytes.Index(data[i][pos:], pattern)
+				if idx < 0 {
+					break
+				}
+
+				pos += idx
+				header := data[i][pos:]
+
+				if len(header) < 8 || !validMinLC(header[6]) || header[7] != 4 && header[7] != 8 {
+					continue
+				}
+
+				addr := segment.addr + uint64(pos)
+
+				text, etext, ok := findModuleData(data, segments, order, header, addr)
+				if !ok {
+					continue
+				}
+
+				return &scannedPCLnTab{
+					data:  io.NewSectionReader(r, int64(segment.offset)+int64(pos), int64(segment.size)-int64(pos)),
+					text:  text,
+					etext: etext,
+				}, nil
+			}
+		}
+	}
+
+	return nil, ErrNotGo("pclntab not found")
+}
+
+func validMinLC(minLC byte) bool { return minLC == 1 || minLC == 2 || minLC == 4 }
+
+// findModuleData finds runtime.firstmoduledata referring pclntab located at provided address
+// and returns text addresses stored in it.
+func findModuleData(data [][]byte, segments []loadSegment, order binary.ByteOrder, header []byte, addr uint64) (text, etext uint64, ok bool) {
+	ptrSize := int(header[7])
+
+	word := func(b []byte, i int) uint64 {
+		if ptrSize == 4 {
+			return uint64(order.Uint32(b[i*4:]))
+		}
+
+		return order.Uint64(b[i*8:])
+	}
+
+	var (
+		textIdx  int
+		validate func(moduleData []byte) bool
+	)
+
+	switch magic := order.Uint32(header); magic {
+	case pcLnTabMagic12:
+		// moduledata begins with pclntable slice
+		textIdx = 12
+		validate = func(moduleData []byte) bool { return word(moduleData, 1) > 0 }
+	default:
+		// moduledata begins with pointer to pcHeader followed by funcnametab slice,
+		// pcHeader contains offset of funcnametab after counts of functions and files (and textStart since 1.18),
+		// these words follow 8 bytes of magic, padding, minLC and ptrSize
+		funcNameOffsetPos := 8 + 3*ptrSize
+		if magic == pcLnTabMagic116 {
+			funcNameOffsetPos = 8 + 2*ptrSize
+		}
+
+		if len(header) < funcNameOffsetPos+ptrSize {
+			return 0, 0, false
+		}
+
+		funcNameOffset := word(header[funcNameOffsetPos:], 0)
+
+		textIdx = 22
+		validate = func(moduleData []byte) bool { return word(moduleData, 1) == addr+funcNameOffset }
+	}
+
+	pattern := make([]byte, ptrSize)
+	if ptrSize == 4 {
+		order.PutUint32(pattern, uint32(addr))
+	} else {
+		order.PutUint64(pattern, addr)
+	}
+
+	for i := range segments {
+		for pos := 0; ; pos++ {
+			idx := bytes.Index(data[i][pos:], pattern)
+			if idx < 0 {
+				break
+			}
+
+			pos += idx
+			moduleData := data[i][pos:]
+
+			if pos%ptrSize != 0 || len(moduleData) < (textIdx+2)*ptrSize || !validate(moduleData) {
+				continue
+			}
+
+			text, etext = word(moduleData, textIdx), word(moduleData, textIdx+1)
+			if text == 0 {
+				// text is zero on wasm where functions are referred by indices, minpc and maxpc preceding it used
+				text, etext = word(moduleData, textIdx-2), word(moduleData, textIdx-1)
+			}
+
+			if text == 0 || text >= etext {
+				continue
+			}
+
+			return text, etext, true
+		}
+	}
+
+	return 0, 0, false
+}
@@ -0,0 +1,162 @@
+package executable
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// rewriteFixture applies modification to content of fixture.
+func rewriteFixture(t *testing.T, path string, modify func(data []byte)) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	modify(data)
+
+	if err = os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatalf("Write fixture: %s", err)
+	}
+}
+
+// checkScanned checks that executable opened using pclntab scan describes same functions as symbol table.
+func checkScanned(t *testing.T, e replacer.Executable, symbols map[string]uint64) {
+	t.Helper()
+
+	if e.TextAddr() != symbols["runtime.text"] {
+		t.Errorf("Unexpected text address: %#x, expected %#x", e.TextAddr(), symbols["runtime.text"])
+	}
+
+	if ranges := e.TextRanges(); len(ranges) != 1 || ranges[0].End != symbols["runtime.etext"] {
+		t.Errorf("Unexpected text ranges: %v", ranges)
+	}
+
+	r, err := replacer.NewReplacer(e)
+	if err != nil {
+		t.Fatalf("Replacer: %s", err)
+	}
+
+	for _, name := range []string{"main.answer", "main.otherAnswer"} {
+		if entry, err := r.Entry(name); err != nil || entry != symbols[name] {
+			t.Errorf("Unexpected entry of %s: %#x, %v", name, entry, err)
+		}
+	}
+
+	if err = r.Replace("main.answer", "main.otherAnswer"); err != nil {
+		t.Errorf("Replace: %s", err)
+	}
+}
+
+func TestELFStrippedSections(t *testing.T) {
+	// like sstrip does: remove section header table from file header (e_shoff, e_shnum, e_shstrndx)
+	strip64 := func(data []byte) {
+		copy(data[0x28:0x30], make([]byte, 8))
+		copy(data[0x3c:0x40], make([]byte, 4))
+	}
+	strip32 := func(data []byte) {
+		copy(data[0x20:0x24], make([]byte, 4))
+		copy(data[0x30:0x34], make([]byte, 4))
+	}
+
+	for name, tc := range map[string]struct {
+		env   []string
+		flags []string
+		strip func(data []byte)
+	}{
+		"exe": {env: []string{"GOARCH=amd64"}, strip: strip64},
+		"pie": {env: []string{"GOARCH=amd64"}, flags: []string{"-buildmode=pie"}, strip: strip64},
+		"386": {env: []string{"GOARCH=386"}, strip: strip32},
+		"arm": {env: []string{"GOARCH=arm"}, strip: strip32},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := buildFixture(t, append([]string{"GOOS=linux", "CGO_ENABLED=0"}, tc.env...), tc.flags...)
+
+			f, err := elf.Open(path)
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			elfSymbols, err := f.Symbols()
+			_ = f.Close()
+
+			if err != nil {
+				t.Fatalf("Symbols: %s", err)
+			}
+
+			symbols := make(map[string]uint64, len(elfSymbols))
+			for _, symbol := range elfSymbols {
+				symbols[symbol.Name] = symbol.Value
+			}
+
+			rewriteFixture(t, path, tc.strip)
+
+			file, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			defer file.Close()
+
+			e, err := NewELF(file)
+			if err != nil {
+				t.Fatalf("Open stripped: %s", err)
+			}
+
+			if len(e.file.Sections) != 0 {
+				t.Fatalf("Sections not stripped")
+			}
+
+			checkScanned(t, e, symbols)
+		})
+	}
+}
+
+func TestMachORenamedPCLnTab(t *testing.T) {
+	path := buildFixture(t, []string{"GOOS=darwin", "GOARCH=arm64", "CGO_ENABLED=0"})
+
+	f, err := macho.Open(path)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	symbols := make(map[string]uint64)
+	for _, symbol := range f.Symtab.Syms {
+		symbols[symbol.Name] = symbol.Value
+	}
+
+	_ = f.Close()
+
+	// pclntab placed to section with other name
+	rewriteFixture(t, path, func(data []byte) {
+		idx := bytes.Index(data, []byte(machoGoPCLnTab+"\x00"))
+		if idx < 0 {
+			t.Fatalf("pclntab section not found")
+		}
+
+		copy(data[idx:], "__rodata2")
+	})
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	defer file.Close()
+
+	e, err := NewMachO(file)
+	if err != nil {
+		t.Fatalf("Open renamed: %s", err)
+	}
+
+	// text section present, so only pclntab found by scan
+	symbols["runtime.etext"] = e.TextRanges()[0].End
+
+	checkScanned(t, e, symbols)
+}
@@ -3,22 +3,39 @@ package executable
 import (
 	"debug/gosym"
 	"debug/pe"
+	"encoding/binary"
 	"fmt"
 	"io"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// Types of base relocations.
+const (
+	peRelBasedAbsolute   = 0
+	peRelBasedHigh       = 1
+	peRelBasedLow        = 2
+	peRelBasedHighLow    = 3
+	peRelBasedHighAdj    = 4
+	peRelBasedARMMov32   = 5
+	peRelBasedThumbMov32 = 7
+	peRelBasedDir64      = 10
 )
 
 type PE struct {
-	io.WriterAt
+	ReadWriterAt
 
 	goarch      string
 	imageBase   uint64
 	textSection *pe.Section
+	sections    []*pe.Section
+	baseRelocs  pe.DataDirectory
 
-	symTabStart, symTabEnd *pe.Symbol
-	symTabSection          *pe.Section
+	symTab, pcLnTab *io.SectionReader
 
-	pcLnTabStart, pcLnTabEnd *pe.Symbol
-	pcLnTabSection           *pe.Section
+	checkSum       *peCheckSum // nil if checksum not set
+	security       pe.DataDirectory
+	securityOffset int64 // offset of security directory entry
 }
 
 func NewPE(rw ReadWriterAt) (*PE, error) {
@@ -27,12 +44,20 @@ func NewPE(rw ReadWriterAt) (*PE, error) {
 		return nil, fmt.Errorf("pe open: %w", err)
 	}
 
-	var imageBase uint64
+	var (
+		imageBase          uint64
+		checkSum           uint32
+		dataDirectories    []pe.DataDirectory
+		dataDirectoryStart int64
+	)
+
 	switch oh := peFile.OptionalHeader.(type) {
 	case *pe.OptionalHeader32:
-		imageBase = uint64(oh.ImageBase)
+		imageBase, checkSum = uint64(oh.ImageBase), oh.CheckSum
+		dataDirectories, dataDirectoryStart = oh.DataDirectory[:min(oh.NumberOfRvaAndSizes, 16)], peDataDirectoryPos
 	case *pe.OptionalHeader64:
-		imageBase = oh.ImageBase
+		imageBase, checkSum = oh.ImageBase, oh.CheckSum
+		dataDirectories, dataDirectoryStart = oh.DataDirectory[:min(oh.NumberOfRvaAndSizes, 16)], peDataDirectoryPos+16
 	default:
 		return nil, ErrNotGo("pe format not recognized")
 	}
@@ -44,14 +69,15 @@ func NewPE(rw ReadWriterAt) (*PE, error) {
 
 	// go stores symtab and pclntab inside other section (currently .text) and their boundaries can be found in symbol values
 
-	symTabStart, symTabEnd, err := startEndSymbols(peFile, "runtime.symtab", "runtime.esymtab")
+	pcLnTab, err := peTable(peFile, "runtime.pclntab", "runtime.epclntab")
 	if err != nil {
 		return nil, err
 	}
 
-	pcLnTabStart, pcLnTabEnd, err := startEndSymbols(peFile, "runtime.pclntab", "runtime.epclntab")
+	// symtab is empty since go1.3, so linker may omit it
+	symTab, err := peTable(peFile, "runtime.symtab", "runtime.esymtab")
 	if err != nil {
-		return nil, err
+		symTab = io.NewSectionReader(rw, 0, 0)
 	}
 
 	goarch := getGOARCH(rw)
@@ -61,41 +87,169 @@ func NewPE(rw ReadWriterAt) (*PE, error) {
 		}
 	}
 
-	return &PE{
-		WriterAt: rw,
+	var headerOffset [4]byte
+	if _, err = rw.ReadAt(headerOffset[:], peHeaderOffsetPos); err != nil {
+		return nil, fmt.Errorf("pe header offset read: %w", err)
+	}
+
+	optionalHeaderOffset := int64(binary.LittleEndian.Uint32(headerOffset[:])) + peSignatureSize + peFileHeaderSize
+
+	ret := &PE{
+		ReadWriterAt: rw,
 
-		goarch:         goarch,
-		imageBase:      imageBase,
-		textSection:    text,
-		symTabStart:    symTabStart,
-		symTabEnd:      symTabEnd,
-		symTabSection:  peFile.Sections[symTabStart.SectionNumber-1],
-		pcLnTabStart:   pcLnTabStart,
-		pcLnTabEnd:     pcLnTabEnd,
-		pcLnTabSection: peFile.Sections[pcLnTabStart.SectionNumber-1],
-	}, nil
+		goarch:      goarch,
+		imageBase:   imageBase,
+		textSection: text,
+		sections:    peFile.Sections,
+		symTab:      symTab,
+		pcLnTab:     pcLnTab,
+	}
+
+	if len(dataDirectories) > pe.IMAGE_DIRECTORY_ENTRY_BASERELOC {
+		ret.baseRelocs = dataDirectories[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC]
+	}
+
+	if len(dataDirectories) > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+		ret.security = dataDirectories[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		ret.securityOffset = optionalHeaderOffset + dataDirectoryStart +
+			pe.IMAGE_DIRECTORY_ENTRY_SECURITY*peDataDirectorySize
+	}
+
+	// go linker doesn't set checksum and loader checks it only if it's set
+	if checkSum != 0 {
+		if ret.checkSum, err = newPECheckSum(rw, optionalHeaderOffset+peCheckSumPos); err != nil {
+			return nil, fmt.Errorf("pe checksum: %w", err)
+		}
+	}
+
+	return ret, nil
 }
 
 func (pe *PE) GOARCH() string { return pe.goarch }
 
 func (pe *PE) TextAddr() uint64 { return pe.imageBase + uint64(pe.textSection.VirtualAddress) }
 
-func (pe *PE) GoSymTabData() io.Reader {
-	return io.NewSectionReader(pe.symTabSection.ReaderAt,
-		int64(pe.symTabStart.Value),
-		int64(pe.symTabEnd.Value-pe.symTabStart.Value),
-	)
+func (pe *PE) TextRanges() []replacer.Range {
+	return []replacer.Range{{Start: pe.TextAddr(), End: pe.TextAddr() + uint64(pe.textSection.Size)}}
 }
 
-func (pe *PE) GoPCLnTabData() io.Reader {
-	return io.NewSectionReader(pe.pcLnTabSection.ReaderAt,
-		int64(pe.pcLnTabStart.Value),
-		int64(pe.pcLnTabEnd.Value-pe.pcLnTabStart.Value),
-	)
+func (pe *PE) GoSymTabData() io.Reader { return io.NewSectionReader(pe.symTab, 0, pe.symTab.Size()) }
+
+func (pe *PE) GoPCLnTabData() io.Reader { return io.NewSectionReader(pe.pcLnTab, 0, pe.pcLnTab.Size()) }
+
+func (pe *PE) Offset(p *gosym.Func) (int64, error) {
+	if p.Entry < pe.TextAddr() || p.Entry >= pe.TextAddr()+uint64(pe.textSection.Size) {
+		return 0, fmt.Errorf("%w: %#x", ErrNotMapped, p.Entry)
+	}
+
+	return int64(p.Entry-pe.imageBase) - int64(pe.textSection.VirtualAddress-pe.textSection.Offset), nil
+}
+
+// WriteAt writes to file and updates checksum (if set).
+func (pe *PE) WriteAt(p []byte, off int64) (int, error) {
+	if pe.checkSum == nil {
+		return pe.ReadWriterAt.WriteAt(p, off)
+	}
+
+	return pe.checkSum.write(pe.ReadWriterAt, p, off)
 }
 
-func (pe *PE) Offset(p *gosym.Func) int64 {
-	return int64(p.Entry-pe.imageBase) - int64(pe.textSection.VirtualAddress-pe.textSection.Offset)
+// Signed reports whether executable contains security directory (Authenticode signature).
+func (pe *PE) Signed() bool { return pe.security.Size > 0 }
+
+// StripSignature removes security directory entry. Certificates stay at the end of file, but they are not used.
+func (pe *PE) StripSignature() error {
+	if !pe.Signed() {
+		return nil
+	}
+
+	if _, err := pe.WriteAt(make([]byte, peDataDirectorySize), pe.securityOffset); err != nil {
+		return fmt.Errorf("strip signature: %w", err)
+	}
+
+	pe.security.VirtualAddress, pe.security.Size = 0, 0
+
+	return nil
+}
+
+// Relocations returns places modified by loader according to base relocations (image may be loaded
+// at address other than ImageBase).
+func (pe *PE) Relocations() ([]replacer.Range, error) {
+	if pe.baseRelocs.Size == 0 {
+		return nil, nil
+	}
+
+	data, err := pe.readRVA(pe.baseRelocs.VirtualAddress, pe.baseRelocs.Size)
+	if err != nil {
+		return nil, fmt.Errorf("read base relocations: %w", err)
+	}
+
+	var relocations []replacer.Range
+
+	// blocks of relocations for 4K page: page RVA, size of block and 16-bit entries (4-bit type, 12-bit offset)
+	for len(data) >= 8 {
+		page, size := binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[4:])
+		if size < 8 || int(size) > len(data) {
+			return nil, fmt.Errorf("bad base relocations block size %d", size)
+		}
+
+		for i := 8; i+2 <= int(size); i += 2 {
+			entry := binary.LittleEndian.Uint16(data[i:])
+
+			var width uint64
+			switch entry >> 12 {
+			case peRelBasedAbsolute:
+				continue // padding
+			case peRelBasedHigh, peRelBasedLow:
+				width = 2
+			case peRelBasedHighAdj:
+				width = 2
+				i += 2 // next entry contains low part of value
+			case peRelBasedDir64, peRelBasedARMMov32, peRelBasedThumbMov32:
+				width = 8
+			default: // peRelBasedHighLow and architecture-specific ones
+				width = 4
+			}
+
+			addr := pe.imageBase + uint64(page) + uint64(entry&0xfff)
+			relocations = append(relocations, replacer.Range{Start: addr, End: addr + width})
+		}
+
+		data = data[size:]
+	}
+
+	return relocations, nil
+}
+
+// readRVA reads data located at relative virtual address.
+func (pe *PE) readRVA(rva, size uint32) ([]byte, error) {
+	for _, section := range pe.sections {
+		if rva < section.VirtualAddress || rva >= section.VirtualAddress+section.VirtualSize {
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err := section.ReadAt(data, int64(rva-section.VirtualAddress)); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("%w: rva %#x", ErrNotMapped, rva)
+}
+
+// peTable returns reader of data located between start and end symbols.
+func peTable(f *pe.File, startSymbol, endSymbol string) (*io.SectionReader, error) {
+	start, end, err := startEndSymbols(f, startSymbol, endSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NewSectionReader(f.Sections[start.SectionNumber-1].ReaderAt,
+		int64(start.Value),
+		int64(end.Value-start.Value),
+	), nil
 }
 
 func startEndSymbols(f *pe.File, startSymbol, endSymbol string) (ssym, esym *pe.Symbol, err error) {
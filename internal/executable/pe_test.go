@@ -0,0 +1,180 @@
+package executable
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// imageCheckSum calculates checksum of PE file like ImageHlp CheckSumMappedFile does.
+func imageCheckSum(data []byte) uint32 {
+	checkSumOffset := int(binary.LittleEndian.Uint32(data[peHeaderOffsetPos:])) + peSignatureSize + peFileHeaderSize + peCheckSumPos
+
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		if i == checkSumOffset || i == checkSumOffset+2 {
+			continue
+		}
+
+		word := uint32(data[i])
+		if i+1 < len(data) {
+			word |= uint32(data[i+1]) << 8
+		}
+
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return sum + uint32(len(data))
+}
+
+// storedCheckSum returns checksum from optional header of PE file.
+func storedCheckSum(t *testing.T, path string) uint32 {
+	t.Helper()
+
+	f, err := pe.Open(path)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	defer f.Close()
+
+	return f.OptionalHeader.(*pe.OptionalHeader64).CheckSum
+}
+
+// setCheckSum rewrites fixture with correct checksum, optionally appending signature.
+func setCheckSum(t *testing.T, path string, signature []byte) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	optionalHeader := int(binary.LittleEndian.Uint32(data[peHeaderOffsetPos:])) + peSignatureSize + peFileHeaderSize
+
+	if signature != nil {
+		// certificates are aligned to 8 bytes
+		data = append(data, make([]byte, int(alignUp(uint64(len(data)), 8))-len(data))...)
+
+		security := data[optionalHeader+peDataDirectoryPos+16+pe.IMAGE_DIRECTORY_ENTRY_SECURITY*peDataDirectorySize:]
+		binary.LittleEndian.PutUint32(security, uint32(len(data)))
+		binary.LittleEndian.PutUint32(security[4:], uint32(len(signature)))
+
+		data = append(data, signature...)
+	}
+
+	binary.LittleEndian.PutUint32(data[optionalHeader+peCheckSumPos:], imageCheckSum(data))
+
+	if err = os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatalf("Write fixture: %s", err)
+	}
+}
+
+// openPE opens PE fixture for patching.
+func openPE(t *testing.T, path string) *PE {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	t.Cleanup(func() { _ = f.Close() })
+
+	e, err := NewPE(f)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	return e
+}
+
+func checkCheckSum(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	if stored, expected := storedCheckSum(t, path), imageCheckSum(data); stored != expected {
+		t.Errorf("Unexpected checksum: %#x, expected %#x", stored, expected)
+	}
+}
+
+func TestPECheckSum(t *testing.T) {
+	env := []string{"GOOS=windows", "GOARCH=amd64", "CGO_ENABLED=0"}
+
+	t.Run("not set", func(t *testing.T) {
+		path := buildFixture(t, env)
+
+		r, err := replacer.NewReplacer(openPE(t, path))
+		if err != nil {
+			t.Fatalf("Replacer: %s", err)
+		}
+
+		if err = r.Replace("main.answer", "main.otherAnswer"); err != nil {
+			t.Fatalf("Replace: %s", err)
+		}
+
+		if checkSum := storedCheckSum(t, path); checkSum != 0 {
+			t.Errorf("Checksum set: %#x", checkSum)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		path := buildFixture(t, env)
+		setCheckSum(t, path, nil)
+
+		e := openPE(t, path)
+
+		r, err := replacer.NewReplacer(e)
+		if err != nil {
+			t.Fatalf("Replacer: %s", err)
+		}
+
+		if err = r.Replace("main.answer", "main.otherAnswer"); err != nil {
+			t.Fatalf("Replace: %s", err)
+		}
+
+		// odd offset and length
+		if _, err = e.WriteAt([]byte{1, 2, 3}, 0x41); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+
+		checkCheckSum(t, path)
+	})
+}
+
+func TestPESignature(t *testing.T) {
+	path := buildFixture(t, []string{"GOOS=windows", "GOARCH=amd64", "CGO_ENABLED=0"})
+
+	// WIN_CERTIFICATE with PKCS#7 type and junk instead of signature
+	signature := []byte{16, 0, 0, 0, 0, 2, 2, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	setCheckSum(t, path, signature)
+
+	e := openPE(t, path)
+
+	var signed Signed = e
+	if !signed.Signed() {
+		t.Fatalf("Signature not detected")
+	}
+
+	if err := signed.StripSignature(); err != nil {
+		t.Fatalf("Strip: %s", err)
+	}
+
+	if signed.Signed() {
+		t.Errorf("Signature not stripped")
+	}
+
+	if e := openPE(t, path); e.Signed() {
+		t.Errorf("Signature not stripped in file")
+	}
+
+	checkCheckSum(t, path)
+}
@@ -0,0 +1,130 @@
+package executable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Offsets inside of PE headers.
+const (
+	peHeaderOffsetPos   = 0x3c // e_lfanew in DOS header
+	peSignatureSize     = 4
+	peFileHeaderSize    = 20
+	peCheckSumPos       = 64 // inside of optional header, same for PE32 and PE32+
+	peDataDirectoryPos  = 96 // inside of PE32 optional header, PE32+ one is 16 bytes larger
+	peDataDirectorySize = 8
+)
+
+// peCheckSum maintains checksum of image in optional header. It's a sum of 16-bit words of file
+// (except checksum itself) with carry folding plus file size, see ImageHlp CheckSumMappedFile.
+type peCheckSum struct {
+	offset int64  // offset of checksum field
+	size   int64  // size of file
+	sum    uint64 // unfolded sum of words, wide enough for any file
+}
+
+func newPECheckSum(r io.ReaderAt, offset int64) (*peCheckSum, error) {
+	size, err := fileSize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &peCheckSum{offset: offset, size: size}
+
+	buf := make([]byte, 1<<16)
+	for pos := int64(0); pos < size; pos += int64(len(buf)) {
+		chunk := buf[:min(int64(len(buf)), size-pos)]
+		if _, err = r.ReadAt(chunk, pos); err != nil {
+			return nil, fmt.Errorf("read at %#x: %w", pos, err)
+		}
+
+		c.sum += c.words(chunk, pos)
+	}
+
+	return c, nil
+}
+
+// words sums 16-bit words of data located at even offset of file.
+func (c *peCheckSum) words(data []byte, off int64) uint64 {
+	var sum uint64
+
+	for i := 0; i < len(data); i += 2 {
+		if pos := off + int64(i); pos >= c.offset && pos < c.offset+4 {
+			continue
+		}
+
+		if i+1 < len(data) {
+			sum += uint64(binary.LittleEndian.Uint16(data[i:]))
+		} else {
+			sum += uint64(data[i]) // odd size of file, last byte padded by zero
+		}
+	}
+
+	return sum
+}
+
+// value returns checksum stored in header.
+func (c *peCheckSum) value() uint32 {
+	sum := c.sum
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return uint32(sum) + uint32(c.size)
+}
+
+// write writes data to file and updates checksum.
+func (c *peCheckSum) write(rw ReadWriterAt, p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > c.size {
+		return 0, fmt.Errorf("write at %#x: outside of file", off)
+	}
+
+	// words containing written bytes
+	start, end := off&^1, min((off+int64(len(p))+1)&^1, c.size)
+
+	region := make([]byte, end-start)
+	if _, err := rw.ReadAt(region, start); err != nil {
+		return 0, fmt.Errorf("read at %#x: %w", start, err)
+	}
+
+	c.sum -= c.words(region, start)
+
+	n, err := rw.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+
+	if _, err = rw.ReadAt(region, start); err != nil {
+		return n, fmt.Errorf("read at %#x: %w", start, err)
+	}
+
+	c.sum += c.words(region, start)
+
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, c.value())
+
+	if _, err = rw.WriteAt(value, c.offset); err != nil {
+		return n, fmt.Errorf("write checksum: %w", err)
+	}
+
+	return n, nil
+}
+
+// fileSize returns size of file if reader able to report it.
+func fileSize(r io.ReaderAt) (int64, error) {
+	switch sized := r.(type) {
+	case interface{ Size() int64 }:
+		return sized.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := sized.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("stat: %w", err)
+		}
+
+		return fi.Size(), nil
+	default:
+		return 0, fmt.Errorf("unable to detect size of file")
+	}
+}
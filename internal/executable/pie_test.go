@@ -0,0 +1,143 @@
+package executable
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/gosym"
+	"debug/pe"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// extraRelocation adds relocation to ones of executable.
+type extraRelocation struct {
+	replacer.Executable
+	relocation replacer.Range
+}
+
+func (e extraRelocation) Relocations() ([]replacer.Range, error) {
+	relocations, err := e.Executable.(replacer.Relocator).Relocations()
+	return append(relocations, e.relocation), err
+}
+
+// sectionCode reads code at address using section headers.
+type sectionCode func(t *testing.T, path string, addr uint64, code []byte)
+
+func elfSectionCode(t *testing.T, path string, addr uint64, code []byte) {
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	defer f.Close()
+
+	text := f.Section(".text")
+	if _, err = text.ReadAt(code, int64(addr-text.Addr)); err != nil {
+		t.Fatalf("Read section: %s", err)
+	}
+}
+
+func peSectionCode(t *testing.T, path string, addr uint64, code []byte) {
+	f, err := pe.Open(path)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	defer f.Close()
+
+	text := f.Section(".text")
+	if _, err = text.ReadAt(code, int64(addr-f.OptionalHeader.(*pe.OptionalHeader64).ImageBase-uint64(text.VirtualAddress))); err != nil {
+		t.Fatalf("Read section: %s", err)
+	}
+}
+
+func TestPIE(t *testing.T) {
+	for name, tc := range map[string]struct {
+		env         []string
+		flags       []string
+		sectionCode sectionCode
+		relocated   bool
+	}{
+		"elf exe": {env: []string{"GOOS=linux"}, flags: []string{"-buildmode=exe"}, sectionCode: elfSectionCode},
+		"elf pie": {env: []string{"GOOS=linux"}, flags: []string{"-buildmode=pie"}, sectionCode: elfSectionCode, relocated: true},
+		"pe exe":  {env: []string{"GOOS=windows"}, flags: []string{"-buildmode=exe"}, sectionCode: peSectionCode},
+		"pe pie":  {env: []string{"GOOS=windows"}, flags: []string{"-buildmode=pie"}, sectionCode: peSectionCode, relocated: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := buildFixture(t, append(tc.env, "GOARCH=amd64", "CGO_ENABLED=0"), tc.flags...)
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			defer f.Close()
+
+			e, err := Recognize(f)
+			if err != nil {
+				t.Fatalf("Recognize: %s", err)
+			}
+
+			relocations, err := e.(replacer.Relocator).Relocations()
+			if err != nil {
+				t.Fatalf("Relocations: %s", err)
+			}
+
+			if tc.relocated && len(relocations) == 0 {
+				t.Errorf("Relocations not found")
+			}
+
+			// go code is position-independent
+			for _, relocation := range relocations {
+				for _, text := range e.TextRanges() {
+					if relocation.Start < text.End && relocation.End > text.Start {
+						t.Errorf("Relocation %#x inside text", relocation.Start)
+					}
+				}
+			}
+
+			r, err := replacer.NewReplacer(e)
+			if err != nil {
+				t.Fatalf("Replacer: %s", err)
+			}
+
+			entry, err := r.Entry("main.answer")
+			if err != nil {
+				t.Fatalf("Entry: %s", err)
+			}
+
+			offset, err := e.Offset(&gosym.Func{Entry: entry})
+			if err != nil {
+				t.Fatalf("Offset: %s", err)
+			}
+
+			code, expected := make([]byte, 16), make([]byte, 16)
+			tc.sectionCode(t, path, entry, expected)
+
+			if _, err = f.ReadAt(code, offset); err != nil {
+				t.Fatalf("Read file: %s", err)
+			}
+
+			if !bytes.Equal(code, expected) {
+				t.Errorf("Unexpected code at offset %#x: %x, expected %x", offset, code, expected)
+			}
+
+			// trampoline must not be overwritten by loader
+			r, err = replacer.NewReplacer(extraRelocation{Executable: e, relocation: replacer.Range{Start: entry + 1, End: entry + 9}})
+			if err != nil {
+				t.Fatalf("Replacer: %s", err)
+			}
+
+			if err = r.Replace("main.answer", "main.otherAnswer"); !errors.Is(err, replacer.ErrRelocatedCode) {
+				t.Errorf("Unexpected error for relocated code: %v", err)
+			}
+
+			if err = r.Replace("main.otherAnswer", "main.answer"); err != nil {
+				t.Errorf("Replace: %s", err)
+			}
+		})
+	}
+}
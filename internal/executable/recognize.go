@@ -27,17 +27,52 @@ func Recognize(rw ReadWriterAt) (replacer.Executable, error) {
 		return nil, fmt.Errorf("mach-o: %w", err)
 	}
 
+	if fat, err := NewFatMachO(rw); err == nil {
+		ret, err := fat.Current()
+		if err != nil {
+			return nil, fmt.Errorf("mach-o fat: %w", err)
+		}
+
+		return ret, nil
+	} else if errors.As(err, &notGo) {
+		return nil, fmt.Errorf("mach-o fat: %w", err)
+	}
+
 	if ret, err := NewPE(rw); err == nil {
 		return ret, nil
 	} else if errors.As(err, &notGo) {
 		return nil, fmt.Errorf("pe: %w", err)
 	}
 
-	// TODO: XCOFF support
+	if ret, err := NewXCOFF(rw); err == nil {
+		return ret, nil
+	} else if errors.As(err, &notGo) {
+		return nil, fmt.Errorf("xcoff: %w", err)
+	}
 
 	return nil, ErrUnknownExecutable
 }
 
+// RecognizeAll acts like Recognize but returns all slices of universal Mach-O binary
+// instead of one for current architecture.
+func RecognizeAll(rw ReadWriterAt) ([]replacer.Executable, error) {
+	if fat, err := NewFatMachO(rw); err == nil {
+		ret := make([]replacer.Executable, len(fat.Slices))
+		for i, slice := range fat.Slices {
+			ret[i] = slice
+		}
+
+		return ret, nil
+	}
+
+	ret, err := Recognize(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	return []replacer.Executable{ret}, nil
+}
+
 func getGOARCH(r io.ReaderAt) string {
 	bi, err := buildinfo.Read(r)
 	if err != nil {
@@ -0,0 +1,86 @@
+package executable
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/gosym"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+func TestELFSharedObject(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil || runtime.GOOS != "linux" {
+		t.Skip("external linker not available")
+	}
+
+	for name, tc := range map[string]struct {
+		flags  []string
+		prefix string // path of main package
+	}{
+		"c-shared": {flags: []string{"-buildmode=c-shared"}, prefix: "main"},
+		"plugin":   {flags: []string{"-buildmode=plugin", "-ldflags=-pluginpath=fixture"}, prefix: "fixture"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := buildFixture(t, []string{"CGO_ENABLED=1"}, tc.flags...)
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			defer f.Close()
+
+			e, err := Recognize(f)
+			if err != nil {
+				t.Fatalf("Recognize: %s", err)
+			}
+
+			if file, ok := e.(*ELF); !ok || e.GOARCH() != runtime.GOARCH {
+				t.Fatalf("Unexpected executable: %T, %s", e, e.GOARCH())
+			} else if file.file.Type != elf.ET_DYN {
+				t.Errorf("Unexpected type: %s", file.file.Type)
+			}
+
+			r, err := replacer.NewReplacer(e)
+			if err != nil {
+				t.Fatalf("Replacer: %s", err)
+			}
+
+			entry, err := r.Entry(tc.prefix + ".answer")
+			if err != nil {
+				t.Fatalf("Entry: %s", err)
+			}
+
+			// C code placed before go one by external linker
+			if symbol, ok := elfSymbol(e.(*ELF).file, tc.prefix+".answer"); !ok || symbol != entry {
+				t.Errorf("Unexpected entry: %#x, expected %#x", entry, symbol)
+			}
+
+			if err = r.Replace(tc.prefix+".answer", tc.prefix+".otherAnswer"); err != nil {
+				t.Fatalf("Replace: %s", err)
+			}
+
+			// shared object is loaded at arbitrary address, but code addresses are relative to its base
+			// and described by sections in same way
+			offset, err := e.Offset(&gosym.Func{Entry: entry})
+			if err != nil {
+				t.Fatalf("Offset: %s", err)
+			}
+
+			code, expected := make([]byte, 16), make([]byte, 16)
+			elfSectionCode(t, path, entry, expected)
+
+			if _, err = f.ReadAt(code, offset); err != nil {
+				t.Fatalf("Read file: %s", err)
+			}
+
+			if !bytes.Equal(code, expected) {
+				t.Errorf("Unexpected code at offset %#x: %x, expected %x", offset, code, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package executable
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// sectionHeader describes location of fields of section header in file.
+type sectionHeader struct {
+	offset                          int64 // offset of header in file
+	addrPos, sizePos, fileOffsetPos int64 // offsets of fields in header
+	fileOffsetSize                  int   // size of file offset field
+}
+
+func (h sectionHeader) write(t *testing.T, f *os.File, addr, size, fileOffset uint64) {
+	t.Helper()
+
+	buf := make([]byte, 8)
+	for _, field := range []struct {
+		pos   int64
+		size  int
+		value uint64
+	}{{h.addrPos, 8, addr}, {h.sizePos, 8, size}, {h.fileOffsetPos, h.fileOffsetSize, fileOffset}} {
+		binary.LittleEndian.PutUint64(buf, field.value)
+		if _, err := f.WriteAt(buf[:field.size], h.offset+field.pos); err != nil {
+			t.Fatalf("Write section header: %s", err)
+		}
+	}
+}
+
+// elfSectionHeaders returns locations of .text and following section headers of 64-bit ELF file.
+// Name of following section replaced by .text.
+func elfSectionHeaders(t *testing.T, f *os.File) (text, next sectionHeader) {
+	t.Helper()
+
+	elfFile, err := elf.NewFile(f)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	header := make([]byte, 64)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		t.Fatalf("Read header: %s", err)
+	}
+
+	shOff := int64(binary.LittleEndian.Uint64(header[0x28:]))
+	shEntSize := int64(binary.LittleEndian.Uint16(header[0x3a:]))
+
+	for i, section := range elfFile.Sections {
+		if section.Name != elfText {
+			continue
+		}
+
+		text = sectionHeader{offset: shOff + int64(i)*shEntSize, addrPos: 0x10, sizePos: 0x20, fileOffsetPos: 0x18, fileOffsetSize: 8}
+		next = text
+		next.offset += shEntSize
+
+		// sh_name is an offset of name in section names table
+		name := make([]byte, 4)
+		if _, err = f.ReadAt(name, text.offset); err != nil {
+			t.Fatalf("Read section name: %s", err)
+		}
+
+		if _, err = f.WriteAt(name, next.offset); err != nil {
+			t.Fatalf("Write section name: %s", err)
+		}
+
+		return text, next
+	}
+
+	t.Fatalf("%s not found", elfText)
+
+	return
+}
+
+// machoSectionHeaders returns locations of __text and following section headers of 64-bit Mach-O file.
+// Name of following section replaced by __text.
+func machoSectionHeaders(t *testing.T, f *os.File) (text, next sectionHeader) {
+	t.Helper()
+
+	const (
+		headerSize        = 32
+		segmentHeaderSize = 72
+		sectionSize       = 80
+	)
+
+	machoFile, err := macho.NewFile(f)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	offset := int64(headerSize)
+	for _, load := range machoFile.Loads {
+		raw := load.Raw()
+
+		if segment, ok := load.(*macho.Segment); ok && segment.Name == machoTextSegment {
+			for i := 0; i < int(segment.Nsect); i++ {
+				sectOffset := offset + segmentHeaderSize + int64(i)*sectionSize
+				sectName := raw[segmentHeaderSize+i*sectionSize:][:16]
+
+				if string(sectName[:len(machoText)]) != machoText || sectName[len(machoText)] != 0 {
+					continue
+				}
+
+				text = sectionHeader{offset: sectOffset, addrPos: 32, sizePos: 40, fileOffsetPos: 48, fileOffsetSize: 4}
+				next = text
+				next.offset += sectionSize
+
+				if _, err = f.WriteAt(sectName, next.offset); err != nil {
+					t.Fatalf("Write section name: %s", err)
+				}
+
+				return text, next
+			}
+		}
+
+		offset += int64(len(raw))
+	}
+
+	t.Fatalf("%s not found", machoText)
+
+	return
+}
+
+func TestSplitText(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		env            []string
+		open           func(rw ReadWriterAt) (replacer.Executable, error)
+		sectionHeaders func(t *testing.T, f *os.File) (text, next sectionHeader)
+	}{
+		{
+			name: "elf",
+			env:  []string{"GOOS=linux", "GOARCH=amd64", "CGO_ENABLED=0"},
+			open: func(rw ReadWriterAt) (replacer.Executable, error) {
+				return NewELF(rw)
+			},
+			sectionHeaders: elfSectionHeaders,
+		},
+		{
+			name: "macho",
+			env:  []string{"GOOS=darwin", "GOARCH=arm64", "CGO_ENABLED=0"},
+			open: func(rw ReadWriterAt) (replacer.Executable, error) {
+				return NewMachO(rw)
+			},
+			sectionHeaders: machoSectionHeaders,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.OpenFile(buildFixture(t, tc.env), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			defer f.Close()
+
+			e, err := tc.open(f)
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+
+			r, err := replacer.NewReplacer(e)
+			if err != nil {
+				t.Fatalf("Replacer: %s", err)
+			}
+
+			answer, _ := r.Entry("main.answer")
+			otherAnswer, _ := r.Entry("main.otherAnswer")
+
+			if answer >= otherAnswer {
+				t.Skip("Unexpected order of functions")
+			}
+
+			text := e.TextRanges()[0]
+			textOffset, err := e.Offset(&gosym.Func{Entry: text.Start})
+			if err != nil {
+				t.Fatalf("Offset: %s", err)
+			}
+
+			// main.answer is in gap between sections, main.otherAnswer begins second section
+			expected := []replacer.Range{{Start: text.Start, End: answer}, {Start: otherAnswer, End: text.End}}
+
+			textHeader, nextHeader := tc.sectionHeaders(t, f)
+			textHeader.write(t, f, text.Start, answer-text.Start, uint64(textOffset))
+			nextHeader.write(t, f, otherAnswer, text.End-otherAnswer, uint64(textOffset)+(otherAnswer-text.Start))
+
+			if e, err = tc.open(f); err != nil {
+				t.Fatalf("Open split: %s", err)
+			}
+
+			if ranges := e.TextRanges(); !reflect.DeepEqual(ranges, expected) {
+				t.Fatalf("Unexpected text ranges: %v, expected %v", ranges, expected)
+			}
+
+			if r, err = replacer.NewReplacer(e); err != nil {
+				t.Fatalf("Replacer: %s", err)
+			}
+
+			if err := r.Replace("main.answer", "main.otherAnswer"); !errors.Is(err, replacer.ErrOutsideText) {
+				t.Errorf("Unexpected error for function outside text: %v", err)
+			}
+
+			if err := r.Replace("main.otherAnswer", "main.answer"); err != nil {
+				t.Errorf("Replace function in second section: %s", err)
+			}
+		})
+	}
+}
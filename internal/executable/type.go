@@ -1,9 +1,25 @@
 package executable
 
 import (
+	"fmt"
 	"io"
 )
 
+// ErrNotMapped returned if virtual address is not mapped to executable file.
+var ErrNotMapped = fmt.Errorf("address is not mapped to file")
+
+// ErrSignedBinary returned if executable contains signature which becomes invalid after patching.
+var ErrSignedBinary = fmt.Errorf("executable is signed")
+
+// Signed implemented by executables which may contain signature invalidated by patching.
+type Signed interface {
+	// Signed reports whether executable contains signature.
+	Signed() bool
+
+	// StripSignature removes signature from executable.
+	StripSignature() error
+}
+
 // ErrNotGo returned if executable is not go-program.
 type ErrNotGo string
 
@@ -16,3 +32,13 @@ type ReadWriterAt interface {
 	io.ReaderAt
 	io.WriterAt
 }
+
+func alignUp(v, align uint64) uint64 { return (v + align - 1) / align * align }
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,410 @@
+package executable
+
+import (
+	"bufio"
+	"bytes"
+	"debug/gosym"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// WebAssembly functions are referred by indices instead of addresses, so there is no way to jump from one function
+// to another. Instead, body of original function replaced by call of replacement.
+// See https://webassembly.github.io/spec/core/binary/modules.html for format details.
+
+const (
+	wasmMagic   = "\x00asm"
+	wasmVersion = 1
+
+	wasmSectionImport   = 2
+	wasmSectionFunction = 3
+	wasmSectionCode     = 10
+	wasmSectionData     = 11
+
+	wasmImportFunc = 0x00
+
+	// wasmFuncValueOffset is a difference between PC_F (upper half of PC in pclntab) and index of function
+	// not including imports, see cmd/link/internal/wasm.
+	wasmFuncValueOffset = 0x1000
+)
+
+// Instructions used in replaced body.
+const (
+	wasmNop      = 0x01
+	wasmEnd      = 0x0b
+	wasmCall     = 0x10
+	wasmLocalGet = 0x20
+	wasmI32Const = 0x41
+)
+
+// wasmBody is a location of function body in file.
+type wasmBody struct {
+	offset, size int64
+}
+
+type WASM struct {
+	ReadWriterAt
+
+	imports uint32     // count of imported functions preceding defined ones in index space
+	types   []uint32   // type indices of defined functions
+	bodies  []wasmBody // bodies of defined functions
+	funcs   map[string]uint32
+}
+
+// NewWASM parses WebAssembly module made by go linker. Functions are found by names from pclntab
+// located in data segments.
+func NewWASM(rw ReadWriterAt) (*WASM, error) {
+	r := &wasmReader{r: bufio.NewReader(io.NewSectionReader(rw, 0, math.MaxInt64))}
+
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("wasm open: %w", err)
+	}
+
+	if string(header[:4]) != wasmMagic {
+		return nil, fmt.Errorf("wasm open: unrecognised magic %x", header[:4])
+	}
+
+	if version := binary.LittleEndian.Uint32(header[4:]); version != wasmVersion {
+		return nil, fmt.Errorf("wasm open: unsupported version %d", version)
+	}
+
+	ret := &WASM{ReadWriterAt: rw}
+
+	var segments []wasmDataSegment
+
+	for {
+		id, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("wasm section read: %w", err)
+		}
+
+		size, err := r.uleb()
+		if err != nil {
+			return nil, fmt.Errorf("wasm section read: %w", err)
+		}
+
+		start := r.offset
+
+		switch id {
+		case wasmSectionImport:
+			err = ret.readImports(r)
+		case wasmSectionFunction:
+			ret.types, err = r.vector()
+		case wasmSectionCode:
+			err = ret.readBodies(r)
+		case wasmSectionData:
+			segments, err = readDataSegments(r)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("wasm section %d read: %w", id, err)
+		}
+
+		if _, err = r.Discard(int(start + int64(size) - r.offset)); err != nil {
+			return nil, fmt.Errorf("wasm section %d read: %w", id, err)
+		}
+	}
+
+	if len(ret.types) != len(ret.bodies) {
+		return nil, fmt.Errorf("wasm: %d functions but %d bodies", len(ret.types), len(ret.bodies))
+	}
+
+	funcs, err := ret.goFuncs(segments)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.funcs = funcs
+
+	return ret, nil
+}
+
+// Replace replaces body of original function by call of replacement.
+// Go functions have the same signature: resume point as parameter and unwinding flag as result.
+// Replacement gets same parameter and its result returned.
+func (w *WASM) Replace(original, replacement string) error {
+	originalIdx, ok := w.funcs[original]
+	if !ok {
+		return fmt.Errorf("source %s: %w", original, replacer.ErrFunctionNotFound)
+	}
+
+	replacementIdx, ok := w.funcs[replacement]
+	if !ok {
+		return fmt.Errorf("target %s: %w", replacement, replacer.ErrFunctionNotFound)
+	}
+
+	if w.types[originalIdx] != w.types[replacementIdx] {
+		return fmt.Errorf("%s and %s have different types", original, replacement)
+	}
+
+	call := []byte{wasmLocalGet, 0, wasmCall}
+	call = binary.AppendUvarint(call, uint64(w.imports+replacementIdx))
+	call = append(call, wasmEnd)
+
+	// size of body is kept, so it's filled by no-ops after empty list of locals
+	body := w.bodies[originalIdx]
+	if body.size < int64(len(call))+1 {
+		return fmt.Errorf("%s: %w", original, replacer.ErrShortFunction)
+	}
+
+	code := bytes.Repeat([]byte{wasmNop}, int(body.size))
+	code[0] = 0 // no locals
+	copy(code[len(code)-len(call):], call)
+
+	if _, err := w.WriteAt(code, body.offset); err != nil {
+		return fmt.Errorf("write body of %s: %w", original, err)
+	}
+
+	return nil
+}
+
+func (w *WASM) readImports(r *wasmReader) error {
+	count, err := r.uleb()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		// module and field names
+		for j := 0; j < 2; j++ {
+			if _, err = r.bytes(); err != nil {
+				return err
+			}
+		}
+
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case wasmImportFunc:
+			w.imports++
+			_, err = r.uleb() // type index
+		default:
+			// go linker imports only functions
+			return fmt.Errorf("unsupported import kind %d", kind)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *WASM) readBodies(r *wasmReader) error {
+	count, err := r.uleb()
+	if err != nil {
+		return err
+	}
+
+	w.bodies = make([]wasmBody, count)
+	for i := range w.bodies {
+		size, err := r.uleb()
+		if err != nil {
+			return err
+		}
+
+		w.bodies[i] = wasmBody{offset: r.offset, size: int64(size)}
+
+		if _, err = r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// goFuncs maps names of go functions to indices using pclntab.
+func (w *WASM) goFuncs(segments []wasmDataSegment) (map[string]uint32, error) {
+	// linker omits blocks of zeroes in data, so segments are joined back to linear memory
+	var memorySize uint64
+	for _, segment := range segments {
+		memorySize = max(memorySize, segment.addr+uint64(len(segment.data)))
+	}
+
+	memory := make([]byte, memorySize)
+	for _, segment := range segments {
+		copy(memory[segment.addr:], segment.data)
+	}
+
+	scanned, err := scanPCLnTab(bytes.NewReader(memory), []loadSegment{{size: memorySize}}, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+
+	pcLnTab, err := io.ReadAll(scanned.data)
+	if err != nil {
+		return nil, fmt.Errorf("pclntab read: %w", err)
+	}
+
+	// offsets of entries are PC_F (not PC = PC_F<<16 + PC_B), so text is zero to get them
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(pcLnTab, 0))
+	if err != nil {
+		return nil, fmt.Errorf("gosym.NewTable failed: %w", err)
+	}
+
+	funcs := make(map[string]uint32, len(table.Funcs))
+	for _, fn := range table.Funcs {
+		idx := fn.Entry - wasmFuncValueOffset
+		if fn.Entry < wasmFuncValueOffset || idx >= uint64(len(w.bodies)) {
+			return nil, fmt.Errorf("bad entry of %s: %#x", fn.Name, fn.Entry)
+		}
+
+		funcs[fn.Name] = uint32(idx)
+	}
+
+	return funcs, nil
+}
+
+// wasmDataSegment is a data placed to linear memory on instantiation.
+type wasmDataSegment struct {
+	addr uint64
+	data []byte
+}
+
+func readDataSegments(r *wasmReader) ([]wasmDataSegment, error) {
+	count, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]wasmDataSegment, count)
+	for i := range segments {
+		// go linker makes active segments of memory 0 with constant offset: 0x00 i32.const offset end
+		var prefix [2]byte
+		if _, err = io.ReadFull(r, prefix[:]); err != nil {
+			return nil, err
+		}
+
+		if prefix != [2]byte{0, wasmI32Const} {
+			return nil, fmt.Errorf("unsupported data segment %x", prefix)
+		}
+
+		addr, err := r.sleb()
+		if err != nil {
+			return nil, err
+		}
+
+		if addr < 0 {
+			return nil, fmt.Errorf("negative data segment offset %d", addr)
+		}
+
+		if end, err := r.ReadByte(); err != nil || end != wasmEnd {
+			return nil, fmt.Errorf("unsupported data segment offset expression")
+		}
+
+		data, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		segments[i] = wasmDataSegment{addr: uint64(addr), data: data}
+	}
+
+	return segments, nil
+}
+
+// wasmReader reads module sequentially tracking offset.
+type wasmReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (r *wasmReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *wasmReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+
+	return b, err
+}
+
+func (r *wasmReader) Discard(n int) (int, error) {
+	n, err := r.r.Discard(n)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *wasmReader) uleb() (uint64, error) { return binary.ReadUvarint(r) }
+
+// sleb reads signed LEB128 integer, binary.ReadVarint can't be used because it expects zig-zag encoding.
+func (r *wasmReader) sleb() (int64, error) {
+	var (
+		value int64
+		shift uint
+	)
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if shift >= 64 {
+			return 0, fmt.Errorf("signed LEB128 overflows 64 bits")
+		}
+
+		value |= int64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				value |= -1 << shift // sign extension
+			}
+
+			return value, nil
+		}
+	}
+}
+
+// bytes reads byte vector prefixed by length.
+func (r *wasmReader) bytes() ([]byte, error) {
+	size, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// vector reads vector of unsigned integers.
+func (r *wasmReader) vector() ([]uint32, error) {
+	count, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]uint32, count)
+	for i := range ret {
+		v, err := r.uleb()
+		if err != nil {
+			return nil, err
+		}
+
+		ret[i] = uint32(v)
+	}
+
+	return ret, nil
+}
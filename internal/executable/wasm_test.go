@@ -0,0 +1,142 @@
+package executable
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// runWASM runs module built for GOOS=js using node.
+func runWASM(t *testing.T, path string) string {
+	t.Helper()
+
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found")
+	}
+
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		t.Fatalf("go env: %s", err)
+	}
+
+	var runner string
+	for _, dir := range []string{"lib/wasm", "misc/wasm"} {
+		if runner = filepath.Join(strings.TrimSpace(string(goroot)), dir, "wasm_exec_node.js"); fileExists(runner) {
+			break
+		}
+	}
+
+	out, err := exec.Command(node, runner, path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Run module: %s\n%s", err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestWASM(t *testing.T) {
+	for _, goos := range []string{"js", "wasip1"} {
+		t.Run(goos, func(t *testing.T) {
+			path := buildFixture(t, []string{"GOOS=" + goos, "GOARCH=wasm"})
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Open fixture: %s", err)
+			}
+
+			defer f.Close()
+
+			if _, err = Recognize(f); !errors.Is(err, ErrUnknownExecutable) {
+				t.Errorf("Unexpected recognition result: %v", err)
+			}
+
+			w, err := NewWASM(f)
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+
+			if err = w.Replace("main.answer", "main.missing"); !errors.Is(err, replacer.ErrFunctionNotFound) {
+				t.Errorf("Unexpected error for missing function: %v", err)
+			}
+
+			if err = w.Replace("main.answer", "main.otherAnswer"); err != nil {
+				t.Fatalf("Replace: %s", err)
+			}
+
+			// module stays valid
+			w, err = NewWASM(f)
+			if err != nil {
+				t.Fatalf("Open patched: %s", err)
+			}
+
+			body := w.bodies[w.funcs["main.answer"]]
+
+			code := make([]byte, body.size)
+			if _, err = f.ReadAt(code, body.offset); err != nil {
+				t.Fatalf("Read body: %s", err)
+			}
+
+			if code[0] != 0 || code[len(code)-1] != wasmEnd {
+				t.Errorf("Unexpected body: %x", code)
+			}
+
+			if goos == "js" {
+				if out := runWASM(t, path); out != "2 2" {
+					t.Errorf("Unexpected output: %q", out)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDataSegments(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		offset   []byte // signed LEB128
+		expected uint64
+		fails    bool
+	}{
+		{name: "small", offset: []byte{0x10}, expected: 0x10},
+		{name: "sign bit", offset: []byte{0xc0, 0x00}, expected: 0x40},
+		{name: "large", offset: []byte{0x80, 0x80, 0x80, 0x80, 0x04}, expected: 0x40000000},
+		{name: "negative", offset: []byte{0x7f}, fails: true},
+		{name: "negative multibyte", offset: []byte{0x80, 0x7f}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			section := append([]byte{1, 0, wasmI32Const}, tc.offset...)
+			section = append(section, wasmEnd, 2, 0xaa, 0xbb)
+
+			segments, err := readDataSegments(&wasmReader{r: bufio.NewReader(bytes.NewReader(section))})
+			if tc.fails {
+				if err == nil {
+					t.Errorf("Segment with offset %x accepted: %v", tc.offset, segments)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Read: %s", err)
+			}
+
+			expected := []wasmDataSegment{{addr: tc.expected, data: []byte{0xaa, 0xbb}}}
+			if !reflect.DeepEqual(segments, expected) {
+				t.Errorf("Unexpected segments: %v, expected %v", segments, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package executable
+
+import (
+	"bytes"
+	"debug/gosym"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+// debug/xcoff is internal package of standard library, so only structures needed for patching are parsed here.
+
+const (
+	xcoffMagic32 = 0737
+	xcoffMagic64 = 0767
+
+	xcoffFileHeaderSize    = 24
+	xcoffSectionHeaderSize = 72
+	xcoffSymbolSize        = 18
+
+	xcoffSectionText = 0x0020 // STYP_TEXT
+)
+
+// xcoffFileHeader is a header of 64-bit XCOFF file.
+type xcoffFileHeader struct {
+	Magic     uint16
+	NSections uint16
+	TimeDate  uint32
+	SymPtr    uint64
+	OptHdr    uint16
+	Flags     uint16
+	NSymbols  uint32
+}
+
+// xcoffSection is a header of 64-bit XCOFF section.
+type xcoffSection struct {
+	Name    [8]byte
+	PAddr   uint64
+	VAddr   uint64
+	Size    uint64
+	ScnPtr  uint64
+	RelPtr  uint64
+	LnnoPtr uint64
+	NReloc  uint32
+	NLnno   uint32
+	Flags   uint32
+	Padding uint32
+}
+
+// xcoffSymbol is an entry of 64-bit XCOFF symbol table.
+type xcoffSymbol struct {
+	Value   uint64
+	Offset  uint32 // offset of name in string table
+	Section int16  // 1-based number of section
+	Type    uint16
+	Class   uint8
+	NumAux  uint8
+}
+
+type XCOFF struct {
+	ReadWriterAt
+
+	goarch          string
+	texts           []xcoffSection // linker splits large text to several sections
+	symTab, pcLnTab *io.SectionReader
+}
+
+func NewXCOFF(rw ReadWriterAt) (*XCOFF, error) {
+	var header xcoffFileHeader
+	if err := binary.Read(io.NewSectionReader(rw, 0, xcoffFileHeaderSize), binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("xcoff open: %w", err)
+	}
+
+	switch header.Magic {
+	case xcoffMagic64:
+	case xcoffMagic32:
+		return nil, ErrNotGo("32-bit xcoff")
+	default:
+		return nil, fmt.Errorf("xcoff open: unrecognised magic 0x%x", header.Magic)
+	}
+
+	sections := make([]xcoffSection, header.NSections)
+	sectionsReader := io.NewSectionReader(rw, xcoffFileHeaderSize+int64(header.OptHdr),
+		int64(header.NSections)*xcoffSectionHeaderSize)
+	if err := binary.Read(sectionsReader, binary.BigEndian, sections); err != nil {
+		return nil, fmt.Errorf("xcoff sections read: %w", err)
+	}
+
+	var texts []xcoffSection
+	for _, section := range sections {
+		if section.Flags&xcoffSectionText != 0 {
+			texts = append(texts, section)
+		}
+	}
+
+	if len(texts) == 0 {
+		return nil, ErrNotGo("text section not found")
+	}
+
+	// go stores symtab and pclntab inside data section and their boundaries can be found in symbol values
+	symbols, err := xcoffSymbols(rw, &header, "runtime.symtab", "runtime.esymtab", "runtime.pclntab", "runtime.epclntab")
+	if err != nil {
+		return nil, err
+	}
+
+	pcLnTab, err := xcoffTable(rw, sections, symbols, "runtime.pclntab", "runtime.epclntab")
+	if err != nil {
+		return nil, err
+	}
+
+	// symtab is empty since go1.3, so linker may omit it
+	symTab, err := xcoffTable(rw, sections, symbols, "runtime.symtab", "runtime.esymtab")
+	if err != nil {
+		symTab = io.NewSectionReader(rw, 0, 0)
+	}
+
+	goarch := getGOARCH(rw)
+	if goarch == "" {
+		// AIX runs only on 64-bit PowerPC
+		goarch = "ppc64"
+	}
+
+	return &XCOFF{
+		ReadWriterAt: rw,
+
+		goarch:  goarch,
+		texts:   texts,
+		symTab:  symTab,
+		pcLnTab: pcLnTab,
+	}, nil
+}
+
+func (x *XCOFF) GOARCH() string { return x.goarch }
+
+func (x *XCOFF) TextAddr() uint64 { return x.texts[0].VAddr }
+
+func (x *XCOFF) TextRanges() []replacer.Range {
+	ranges := make([]replacer.Range, len(x.texts))
+	for i, text := range x.texts {
+		ranges[i] = replacer.Range{Start: text.VAddr, End: text.VAddr + text.Size}
+	}
+
+	return ranges
+}
+
+func (x *XCOFF) GoSymTabData() io.Reader { return io.NewSectionReader(x.symTab, 0, x.symTab.Size()) }
+
+func (x *XCOFF) GoPCLnTabData() io.Reader { return io.NewSectionReader(x.pcLnTab, 0, x.pcLnTab.Size()) }
+
+func (x *XCOFF) Offset(p *gosym.Func) (int64, error) {
+	for _, text := range x.texts {
+		if p.Entry >= text.VAddr && p.Entry < text.VAddr+text.Size {
+			return int64(p.Entry - text.VAddr + text.ScnPtr), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %#x", ErrNotMapped, p.Entry)
+}
+
+// xcoffSymbols finds symbols with provided names in symbol table.
+func xcoffSymbols(r io.ReaderAt, header *xcoffFileHeader, names ...string) (map[string]xcoffSymbol, error) {
+	if header.SymPtr == 0 || header.NSymbols == 0 {
+		return nil, ErrNotGo("no symbol table")
+	}
+
+	// string table located right after symbol table, its first 4 bytes contain length including them
+	strTabOffset := int64(header.SymPtr) + int64(header.NSymbols)*xcoffSymbolSize
+
+	var strTabSize uint32
+	if err := binary.Read(io.NewSectionReader(r, strTabOffset, 4), binary.BigEndian, &strTabSize); err != nil {
+		return nil, fmt.Errorf("xcoff string table read: %w", err)
+	}
+
+	strTab := make([]byte, strTabSize)
+	if _, err := r.ReadAt(strTab, strTabOffset); err != nil {
+		return nil, fmt.Errorf("xcoff string table read: %w", err)
+	}
+
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+	}
+
+	symbols := make(map[string]xcoffSymbol, len(names))
+	symTab := io.NewSectionReader(r, int64(header.SymPtr), strTabOffset-int64(header.SymPtr))
+
+	for i := uint32(0); i < header.NSymbols; i++ {
+		var symbol xcoffSymbol
+		if err := binary.Read(symTab, binary.BigEndian, &symbol); err != nil {
+			return nil, fmt.Errorf("xcoff symbol table read: %w", err)
+		}
+
+		// auxiliary entries follow symbol
+		if _, err := symTab.Seek(int64(symbol.NumAux)*xcoffSymbolSize, io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("xcoff symbol table read: %w", err)
+		}
+		i += uint32(symbol.NumAux)
+
+		if symbol.Offset < 4 || symbol.Offset >= strTabSize {
+			continue
+		}
+
+		name := strTab[symbol.Offset:]
+		if idx := bytes.IndexByte(name, 0); idx >= 0 {
+			name = name[:idx]
+		}
+
+		if _, ok := wanted[string(name)]; ok {
+			symbols[string(name)] = symbol
+		}
+	}
+
+	return symbols, nil
+}
+
+// xcoffTable returns reader of data located between start and end symbols.
+func xcoffTable(r io.ReaderAt, sections []xcoffSection, symbols map[string]xcoffSymbol, start, end string) (*io.SectionReader, error) {
+	startSymbol, ok := symbols[start]
+	if !ok {
+		return nil, ErrNotGo(fmt.Sprintf("start symbol %s not found", start))
+	}
+
+	endSymbol, ok := symbols[end]
+	if !ok {
+		return nil, ErrNotGo(fmt.Sprintf("end symbol %s not found", end))
+	}
+
+	if startSymbol.Section <= 0 || int(startSymbol.Section) > len(sections) {
+		return nil, ErrNotGo(fmt.Sprintf("bad section number %d", startSymbol.Section))
+	}
+
+	if startSymbol.Section != endSymbol.Section {
+		return nil, ErrNotGo(fmt.Sprintf("start/end symbol in different sections: %d/%d",
+			startSymbol.Section, endSymbol.Section))
+	}
+
+	section := sections[startSymbol.Section-1]
+	if startSymbol.Value < section.VAddr || endSymbol.Value < startSymbol.Value ||
+		endSymbol.Value > section.VAddr+section.Size {
+		return nil, ErrNotGo(fmt.Sprintf("symbols %s/%s out of section", start, end))
+	}
+
+	return io.NewSectionReader(r,
+		int64(section.ScnPtr+startSymbol.Value-section.VAddr),
+		int64(endSymbol.Value-startSymbol.Value),
+	), nil
+}
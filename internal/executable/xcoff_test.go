@@ -0,0 +1,127 @@
+package executable
+
+import (
+	"bytes"
+	"debug/gosym"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey/internal/replacer"
+)
+
+func TestXCOFF(t *testing.T) {
+	f, err := os.OpenFile(buildFixture(t, []string{"GOOS=aix", "GOARCH=ppc64", "CGO_ENABLED=0"}), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	defer f.Close()
+
+	e, err := Recognize(f)
+	if err != nil {
+		t.Fatalf("Recognize: %s", err)
+	}
+
+	if _, ok := e.(*XCOFF); !ok || e.GOARCH() != "ppc64" {
+		t.Fatalf("Unexpected executable: %T, %s", e, e.GOARCH())
+	}
+
+	r, err := replacer.NewReplacer(e)
+	if err != nil {
+		t.Fatalf("Replacer: %s", err)
+	}
+
+	entry, err := r.Entry("main.answer")
+	if err != nil {
+		t.Fatalf("Entry: %s", err)
+	}
+
+	target, err := r.Entry("main.otherAnswer")
+	if err != nil {
+		t.Fatalf("Entry: %s", err)
+	}
+
+	offset, err := e.Offset(&gosym.Func{Entry: entry})
+	if err != nil {
+		t.Fatalf("Offset: %s", err)
+	}
+
+	code := make([]byte, 8)
+	if _, err := f.ReadAt(code, offset); err != nil {
+		t.Fatalf("Read code: %s", err)
+	}
+
+	// MOVD $1, R3; RET
+	if !bytes.Equal(code, []byte{0x38, 0x60, 0x00, 0x01, 0x4e, 0x80, 0x00, 0x20}) {
+		t.Fatalf("Unexpected code at function offset: %x", code)
+	}
+
+	if err := r.Replace("main.answer", "main.otherAnswer"); err != nil {
+		t.Fatalf("Replace: %s", err)
+	}
+
+	if _, err := f.ReadAt(code, offset); err != nil {
+		t.Fatalf("Read code: %s", err)
+	}
+
+	if instr := binary.BigEndian.Uint32(code); instr != 0x48000000|uint32(target-entry)&0x3fffffc {
+		t.Errorf("Unexpected trampoline: %08x", instr)
+	}
+}
+
+// gappedText describes text of executable as two sections with gap between them.
+type gappedText struct {
+	replacer.Executable
+	gapStart, gapEnd uint64
+}
+
+func (g gappedText) TextRanges() []replacer.Range {
+	text := g.Executable.TextRanges()[0]
+	return []replacer.Range{{Start: text.Start, End: g.gapStart}, {Start: g.gapEnd, End: text.End}}
+}
+
+func TestXCOFFTextRanges(t *testing.T) {
+	f, err := os.OpenFile(buildFixture(t, []string{"GOOS=aix", "GOARCH=ppc64", "CGO_ENABLED=0"}), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open fixture: %s", err)
+	}
+
+	defer f.Close()
+
+	e, err := NewXCOFF(f)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	if ranges := e.TextRanges(); len(ranges) != 1 || ranges[0].Start != e.TextAddr() || ranges[0].End <= ranges[0].Start {
+		t.Fatalf("Unexpected text ranges: %v", ranges)
+	}
+
+	r, err := replacer.NewReplacer(e)
+	if err != nil {
+		t.Fatalf("Replacer: %s", err)
+	}
+
+	answer, _ := r.Entry("main.answer")
+	otherAnswer, _ := r.Entry("main.otherAnswer")
+
+	if answer >= otherAnswer {
+		t.Skip("Unexpected order of functions")
+	}
+
+	// main.answer is in gap, main.otherAnswer begins second section
+	r, err = replacer.NewReplacer(gappedText{Executable: e, gapStart: answer, gapEnd: otherAnswer})
+	if err != nil {
+		t.Fatalf("Replacer: %s", err)
+	}
+
+	if err := r.Replace("main.answer", "main.otherAnswer"); !errors.Is(err, replacer.ErrOutsideText) {
+		t.Errorf("Unexpected error for function outside text: %v", err)
+	}
+
+	if err := r.Replace("main.otherAnswer", "main.answer"); err != nil {
+		t.Errorf("Replace function in second section: %s", err)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build integration
+
+package registrytest_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/xakep666/monkey"
+	"github.com/xakep666/monkey/internal/registrytest"
+)
+
+//go:noinline
+func Farewell() string { return "bye" }
+
+func init() {
+	// merged with replacement registered by imported package
+	monkey.Register(Farewell, func() string {
+		return "patched bye"
+	})
+}
+
+func TestMain(m *testing.M) {
+	monkey.MustPatchAndExec()
+	os.Exit(m.Run())
+}
+
+func TestRegistry_Integration(t *testing.T) {
+	if !monkey.IsPatched() {
+		t.Fatal("Not running patched executable")
+	}
+
+	if ret := registrytest.Greeting(); ret != "patched hello" {
+		t.Errorf("Replacement registered by other package not applied, returned: %s", ret)
+	}
+
+	if ret := Farewell(); ret != "patched bye" {
+		t.Errorf("Replacement registered by test not applied, returned: %s", ret)
+	}
+
+	if replacements := monkey.AppliedReplacements(); len(replacements) != 2 {
+		t.Errorf("Unexpected replacements: %v", replacements)
+	}
+}
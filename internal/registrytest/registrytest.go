@@ -0,0 +1,14 @@
+// Package registrytest registers replacement in process-wide registry from its init function,
+// so tests may check that replacements registered by different packages are applied at once.
+package registrytest
+
+import "github.com/xakep666/monkey"
+
+//go:noinline
+func Greeting() string { return "hello" }
+
+func init() {
+	monkey.Register(Greeting, func() string {
+		return "patched hello"
+	})
+}
@@ -0,0 +1,356 @@
+package replacer
+
+import (
+	"bytes"
+	"debug/gosym"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// ErrUnsupportedPrologue returned if beginning of function can't be moved to call original function after
+// its replacement (see Hook).
+var ErrUnsupportedPrologue = fmt.Errorf("unsupported function prologue")
+
+const (
+	// HookSize is a size of pad region used by Hook.
+	HookSize = 64
+
+	// hookGateOffset is an offset of gate inside pad region, indirect trampoline placed before it.
+	hookGateOffset = 32
+)
+
+// patch is a code placed at specified address.
+type patch struct {
+	addr uint64
+	code []byte
+}
+
+// hookGenerator generates code calling original function after its beginning replaced by trampoline.
+type hookGenerator interface {
+	trampolineGenerator
+	indirectTrampolineGenerator
+
+	// GenerateGate returns "gate" placed at provided address. Gate executes instructions of source function
+	// overwritten by trampoline of provided length and jumps to the rest of function. Code of source function
+	// provided starting from entry. Returned patches redirect jumps back to entry (made after stack growth) to gate,
+	// so stack growth in original function doesn't call replacement again.
+	GenerateGate(source *gosym.Func, code []byte, gate uint64, trampolineLen int) ([]byte, []patch, error)
+}
+
+// Hook puts "trampoline code" to beginning of function with sourceName that calls function value located at
+// provided address like ReplaceIndirect does and makes "gate" calling original function. Trampoline and gate are
+// placed to pad: region of at least HookSize bytes inside existing function which is never called.
+// While function value is not set original function called. Address of gate returned.
+// Not all architectures supported, ErrUnsupportedArchitecture returned for them.
+func (r *Replacer) Hook(sourceName string, funcValueAddr, padAddr uint64) (uint64, error) {
+	generator, ok := r.generator.(hookGenerator)
+	if !ok {
+		return 0, ErrUnsupportedArchitecture
+	}
+
+	sourceFunc, ok := r.funcIdx[sourceName]
+	if !ok {
+		return 0, fmt.Errorf("source %s: %w", sourceName, ErrFunctionNotFound)
+	}
+
+	if err := r.checkText(&sourceFunc); err != nil {
+		return 0, err
+	}
+
+	if padFunc := r.gosymtab.PCToFunc(padAddr); padFunc == nil || padAddr+HookSize > padFunc.End {
+		return 0, fmt.Errorf("pad %#x is not inside function", padAddr)
+	}
+
+	offset, err := r.executable.Offset(&sourceFunc)
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", sourceName, err)
+	}
+
+	code := make([]byte, sourceFunc.End-sourceFunc.Entry)
+	if _, err = r.executable.ReadAt(code, offset); err != nil {
+		return 0, fmt.Errorf("read %s: %w", sourceName, err)
+	}
+
+	pad := &gosym.Func{Entry: padAddr}
+	gate := &gosym.Func{Entry: padAddr + hookGateOffset}
+
+	trampoline, err := generator.GenerateTrampoline(&sourceFunc, pad)
+	if err != nil {
+		return 0, err
+	}
+
+	thunk, err := generator.GenerateIndirectTrampoline(pad, funcValueAddr, gate)
+	if err != nil {
+		return 0, err
+	}
+
+	if bytes.HasPrefix(code, trampoline) {
+		// executable patched before (i.e. copy of patched executable), gate is in place already
+		if err = r.writeAt(thunk, pad.Entry); err != nil {
+			return 0, fmt.Errorf("write hook: %w", err)
+		}
+
+		return gate.Entry, nil
+	}
+
+	gateCode, patches, err := generator.GenerateGate(&sourceFunc, code, gate.Entry, len(trampoline))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", sourceName, err)
+	}
+
+	if len(thunk) > hookGateOffset || len(gateCode) > HookSize-hookGateOffset {
+		return 0, fmt.Errorf("%s: hook doesn't fit into pad", sourceName)
+	}
+
+	patches = append(patches,
+		patch{addr: pad.Entry, code: thunk},
+		patch{addr: gate.Entry, code: gateCode},
+		patch{addr: sourceFunc.Entry, code: trampoline},
+	)
+
+	for _, p := range patches {
+		if err = r.writeAt(p.code, p.addr); err != nil {
+			return 0, fmt.Errorf("write hook: %w", err)
+		}
+	}
+
+	return gate.Entry, nil
+}
+
+// SupportsHook reports whether Hook supported for architecture.
+func SupportsHook(goarch string) bool {
+	generator, err := trampolineFromGOARCH(goarch)
+	if err != nil {
+		return false
+	}
+
+	_, ok := generator.(hookGenerator)
+	return ok
+}
+
+// x86StackCheck contains instructions found in beginning of functions compiled by go which may be moved
+// to gate as is. Conditional jumps handled separately.
+var x86StackCheck = [][]byte{
+	{0x49, 0x3b, 0x66, 0x10}, // cmp rsp, [r14+16]
+	{0x4d, 0x3b, 0x66, 0x10}, // cmp r12, [r14+16]
+	{0x49, 0x89, 0xe4},       // mov r12, rsp
+	{0x55},                   // push rbp
+	{0x48, 0x89, 0xe5},       // mov rbp, rsp
+}
+
+// x86StackCheckImm contains prefixes of instructions with immediate operand which may be moved to gate as is
+// mapped to instruction length.
+var x86StackCheckImm = []struct {
+	prefix []byte
+	len    int
+}{
+	{prefix: []byte{0x49, 0x81, 0xec}, len: 7},       // sub r12, imm32
+	{prefix: []byte{0x4c, 0x8d, 0x64, 0x24}, len: 5}, // lea r12, [rsp+disp8]
+	{prefix: []byte{0x4c, 0x8d, 0xa4, 0x24}, len: 8}, // lea r12, [rsp+disp32]
+	{prefix: []byte{0x48, 0x83, 0xec}, len: 4},       // sub rsp, imm8
+	{prefix: []byte{0x48, 0x81, 0xec}, len: 7},       // sub rsp, imm32
+}
+
+// amd64 is x86 supporting hooks, beginnings of functions decoded using 64-bit instruction set.
+type amd64 struct{ x86 }
+
+func (g amd64) GenerateGate(source *gosym.Func, code []byte, gate uint64, trampolineLen int) ([]byte, []patch, error) {
+	ret, morestack, err := g.relocate(source, code, gate, trampolineLen)
+	if err != nil || morestack < 0 {
+		return ret, nil, err
+	}
+
+	reentry, short, err := x86FindReentry(code, morestack)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !short {
+		jump, err := g.GenerateTrampoline(&gosym.Func{Entry: source.Entry + uint64(reentry)}, &gosym.Func{Entry: gate})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return ret, []patch{{addr: source.Entry + uint64(reentry), code: jump}}, nil
+	}
+
+	// short jump can't reach gate, so it's redirected to jump placed to space freed by moving
+	// more instructions from beginning of function to gate
+	ret, _, err = g.relocate(source, code, gate, trampolineLen*2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jump, err := g.GenerateTrampoline(&gosym.Func{Entry: source.Entry + uint64(trampolineLen)}, &gosym.Func{Entry: gate})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ret, []patch{
+		{addr: source.Entry + uint64(trampolineLen), code: jump},
+		{addr: source.Entry + uint64(reentry), code: []byte{0xeb, byte(trampolineLen - (reentry + 2))}},
+	}, nil
+}
+
+// relocate moves instructions from beginning of function covering at least provided count of bytes to gate.
+// Offset of block calling runtime.morestack returned if stack check found, -1 otherwise.
+func (g amd64) relocate(source *gosym.Func, code []byte, gate uint64, size int) ([]byte, int, error) {
+	var (
+		ret       []byte
+		morestack = -1
+		off       int
+	)
+
+	for off < size {
+		n, target, cond := x86Decode(code[off:])
+		switch {
+		case n == 0:
+			return nil, -1, fmt.Errorf("%w: instruction % x", ErrUnsupportedPrologue, code[off:min(off+8, len(code))])
+		case cond == 0:
+			ret = append(ret, code[off:off+n]...)
+		default:
+			// conditional jump relocated to "jcc rel32" form
+			target += off + n
+			if target < 0 || target >= len(code) {
+				return nil, -1, fmt.Errorf("%w: jump outside of function", ErrUnsupportedPrologue)
+			}
+
+			if cond == 0x86 { // jbe taken if stack must grow
+				morestack = target
+			}
+
+			rel := int64(source.Entry) + int64(target) - int64(gate+uint64(len(ret))+6)
+			if rel < math.MinInt32 || rel > math.MaxInt32 {
+				return nil, -1, ErrLongDistance
+			}
+
+			ret = append(ret, 0x0f, cond, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(ret[len(ret)-4:], uint32(rel))
+		}
+
+		off += n
+	}
+
+	jump, err := g.GenerateTrampoline(&gosym.Func{Entry: gate + uint64(len(ret))}, &gosym.Func{Entry: source.Entry + uint64(off)})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// stack check of functions with large frames may be not moved completely
+	for next := off; morestack < 0; {
+		n, target, cond := x86Decode(code[next:])
+		if n == 0 {
+			break
+		}
+
+		if next += n; cond == 0x86 {
+			morestack = next + target
+		}
+	}
+
+	return append(ret, jump...), morestack, nil
+}
+
+// x86Decode decodes instruction allowed in gate and returns its length. For conditional jumps relative target
+// and opcode of "jcc rel32" form returned, opcode is zero for other instructions.
+func x86Decode(code []byte) (n, target int, cond byte) {
+	for _, instr := range x86StackCheck {
+		if bytes.HasPrefix(code, instr) {
+			return len(instr), 0, 0
+		}
+	}
+
+	for _, instr := range x86StackCheckImm {
+		if bytes.HasPrefix(code, instr.prefix) && len(code) >= instr.len {
+			return instr.len, 0, 0
+		}
+	}
+
+	switch {
+	case len(code) >= 2 && (code[0] == 0x76 || code[0] == 0x72): // jbe/jb rel8
+		return 2, int(int8(code[1])), code[0] + 0x10
+	case len(code) >= 6 && code[0] == 0x0f && (code[1] == 0x86 || code[1] == 0x82): // jbe/jb rel32
+		return 6, int(int32(binary.LittleEndian.Uint32(code[2:]))), code[1]
+	default:
+		return 0, 0, 0
+	}
+}
+
+// x86FindReentry returns offset of jump to entry at the end of block calling runtime.morestack
+// and reports whether it's a short jump.
+func x86FindReentry(code []byte, morestack int) (int, bool, error) {
+	for i := morestack; i < len(code); i++ {
+		switch {
+		case code[i] == 0xe9 && i+5 <= len(code) && i+5+int(int32(binary.LittleEndian.Uint32(code[i+1:]))) == 0:
+			return i, false, nil
+		case code[i] == 0xeb && i+2 <= len(code) && i+2+int(int8(code[i+1])) == 0:
+			return i, true, nil
+		}
+	}
+
+	return 0, false, fmt.Errorf("%w: return from runtime.morestack not found", ErrUnsupportedPrologue)
+}
+
+func (g arm64) GenerateGate(source *gosym.Func, code []byte, gate uint64, trampolineLen int) ([]byte, []patch, error) {
+	const stackCheck = 0xf9400b90 // ldr x16, [x28, #16]
+
+	if trampolineLen != 4 || len(code) < 4 {
+		return nil, nil, ErrShortFunction
+	}
+
+	instr := binary.LittleEndian.Uint32(code)
+	if arm64PCRelative(instr) {
+		return nil, nil, fmt.Errorf("%w: instruction %#08x", ErrUnsupportedPrologue, instr)
+	}
+
+	jump, err := g.GenerateTrampoline(&gosym.Func{Entry: gate + 4}, &gosym.Func{Entry: source.Entry + 4})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ret := binary.LittleEndian.AppendUint32(nil, instr)
+	ret = append(ret, jump...)
+
+	// instructions are aligned, so all jumps to entry may be found exactly
+	var patches []patch
+	for i := 4; i+4 <= len(code); i += 4 {
+		instr := binary.LittleEndian.Uint32(code[i:])
+		if instr&0xfc000000 != 0x14000000 || int32(instr<<6)>>4 != -int32(i) { // b entry
+			continue
+		}
+
+		jump, err := g.GenerateTrampoline(&gosym.Func{Entry: source.Entry + uint64(i)}, &gosym.Func{Entry: gate})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		patches = append(patches, patch{addr: source.Entry + uint64(i), code: jump})
+	}
+
+	if instr == stackCheck && len(patches) == 0 {
+		return nil, nil, fmt.Errorf("%w: return from runtime.morestack not found", ErrUnsupportedPrologue)
+	}
+
+	return ret, patches, nil
+}
+
+// arm64PCRelative reports whether instruction uses program counter, so it can't be moved.
+func arm64PCRelative(instr uint32) bool {
+	switch {
+	case instr&0x7c000000 == 0x14000000: // b, bl
+		return true
+	case instr&0xff000010 == 0x54000000: // b.cond
+		return true
+	case instr&0x7e000000 == 0x34000000: // cbz, cbnz
+		return true
+	case instr&0x7e000000 == 0x36000000: // tbz, tbnz
+		return true
+	case instr&0x1f000000 == 0x10000000: // adr, adrp
+		return true
+	case instr&0x3b000000 == 0x18000000: // ldr (literal)
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,398 @@
+package replacer
+
+import (
+	"bytes"
+	"debug/gosym"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+const (
+	testSource = 0x1000
+	testPad    = 0x5000
+	testGate   = testPad + hookGateOffset
+)
+
+// nops returns code padded by nop instructions up to provided length.
+func nops(code []byte, n int) []byte {
+	for len(code) < n {
+		code = append(code, 0x90)
+	}
+
+	return code
+}
+
+func TestAMD64GenerateGate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     []byte
+		gate     []byte
+		patches  []patch
+		expected error
+	}{
+		{
+			name: "stack check",
+			code: append(nops([]byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x76, 0x1a, // jbe morestack
+				0x55,             // push rbp
+				0x48, 0x89, 0xe5, // mov rbp, rsp
+				0x48, 0x83, 0xec, 0x10, // sub rsp, 16
+			}, 0x20),
+				0xe8, 0x00, 0x00, 0x00, 0x00, // morestack: call runtime.morestack
+				0xe9, 0xd6, 0xff, 0xff, 0xff, // jmp entry
+			),
+			gate: []byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x0f, 0x86, 0xf6, 0xbf, 0xff, 0xff, // jbe morestack
+				0xe9, 0xd7, 0xbf, 0xff, 0xff, // jmp entry+6
+			},
+			patches: []patch{{addr: testSource + 0x25, code: []byte{0xe9, 0xf6, 0x3f, 0x00, 0x00}}}, // jmp gate
+		},
+		{
+			name: "short jump to entry",
+			code: append(nops([]byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x76, 0x0f, // jbe morestack
+				0x55,             // push rbp
+				0x48, 0x89, 0xe5, // mov rbp, rsp
+				0x48, 0x83, 0xec, 0x10, // sub rsp, 16
+			}, 0x15),
+				0xe8, 0x00, 0x00, 0x00, 0x00, // morestack: call runtime.morestack
+				0xeb, 0xe4, // jmp entry
+			),
+			gate: []byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x0f, 0x86, 0xeb, 0xbf, 0xff, 0xff, // jbe morestack
+				0x55,             // push rbp
+				0x48, 0x89, 0xe5, // mov rbp, rsp
+				0xe9, 0xd7, 0xbf, 0xff, 0xff, // jmp entry+10
+			},
+			patches: []patch{
+				{addr: testSource + 5, code: []byte{0xe9, 0x16, 0x40, 0x00, 0x00}}, // jmp gate
+				{addr: testSource + 0x1a, code: []byte{0xeb, 0xe9}},                // jmp entry+5
+			},
+		},
+		{
+			name: "large frame",
+			code: append(nops([]byte{
+				0x4c, 0x8d, 0xa4, 0x24, 0x00, 0xf0, 0xff, 0xff, // lea r12, [rsp-0x1000]
+				0x4d, 0x3b, 0x66, 0x10, // cmp r12, [r14+16]
+				0x0f, 0x86, 0x0e, 0x00, 0x00, 0x00, // jbe morestack
+				0x55, // push rbp
+			}, 0x20),
+				0xe8, 0x00, 0x00, 0x00, 0x00, // morestack: call runtime.morestack
+				0xe9, 0xd6, 0xff, 0xff, 0xff, // jmp entry
+			),
+			gate: []byte{
+				0x4c, 0x8d, 0xa4, 0x24, 0x00, 0xf0, 0xff, 0xff, // lea r12, [rsp-0x1000]
+				0xe9, 0xdb, 0xbf, 0xff, 0xff, // jmp entry+8
+			},
+			patches: []patch{{addr: testSource + 0x25, code: []byte{0xe9, 0xf6, 0x3f, 0x00, 0x00}}}, // jmp gate
+		},
+		{
+			name: "no stack check",
+			code: []byte{
+				0x55,             // push rbp
+				0x48, 0x89, 0xe5, // mov rbp, rsp
+				0x48, 0x83, 0xec, 0x18, // sub rsp, 24
+				0xc3, // ret
+			},
+			gate: []byte{
+				0x55,             // push rbp
+				0x48, 0x89, 0xe5, // mov rbp, rsp
+				0x48, 0x83, 0xec, 0x18, // sub rsp, 24
+				0xe9, 0xdb, 0xbf, 0xff, 0xff, // jmp entry+8
+			},
+		},
+		{
+			name: "jb",
+			code: []byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x72, 0x02, // jb entry+8
+				0xc3, 0xc3, // ret
+				0xc3, // ret
+			},
+			gate: []byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x0f, 0x82, 0xde, 0xbf, 0xff, 0xff, // jb entry+8
+				0xe9, 0xd7, 0xbf, 0xff, 0xff, // jmp entry+6
+			},
+		},
+		{
+			name:     "unknown instruction",
+			code:     []byte{0x31, 0xc0, 0xc3}, // xor eax, eax; ret
+			expected: ErrUnsupportedPrologue,
+		},
+		{
+			name: "jump outside of function",
+			code: []byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x76, 0x7f, // jbe entry+0x85
+			},
+			expected: ErrUnsupportedPrologue,
+		},
+		{
+			name: "no return from morestack",
+			code: []byte{
+				0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+				0x76, 0x04, // jbe morestack
+				0x55,             // push rbp
+				0x48, 0x89, 0xe5, // mov rbp, rsp
+				0xe8, 0x00, 0x00, 0x00, 0x00, // morestack: call runtime.morestack
+				0xc3, // ret
+			},
+			expected: ErrUnsupportedPrologue,
+		},
+	} {
+		gate, patches, err := amd64{}.GenerateGate(&gosym.Func{Entry: testSource}, tc.code, testGate, 5)
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+
+		if !bytes.Equal(gate, tc.gate) {
+			t.Errorf("%s: unexpected gate: % x, expected % x", tc.name, gate, tc.gate)
+		}
+
+		if !slices.EqualFunc(patches, tc.patches, equalPatch) {
+			t.Errorf("%s: unexpected patches: %x, expected %x", tc.name, patches, tc.patches)
+		}
+	}
+}
+
+func TestAMD64GenerateGateLongDistance(t *testing.T) {
+	code := []byte{
+		0x49, 0x3b, 0x66, 0x10, // cmp rsp, [r14+16]
+		0x72, 0x00, // jb entry+6
+		0xc3, // ret
+	}
+
+	if _, _, err := (amd64{}).GenerateGate(&gosym.Func{Entry: testSource}, code, testSource+1<<32, 5); !errors.Is(err, ErrLongDistance) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestARM64GenerateGate(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		code          []byte
+		trampolineLen int
+		gate          []byte
+		patches       []patch
+		expected      error
+	}{
+		{
+			name: "stack check",
+			code: le32(
+				0xf9400b90, // ldr x16, [x28, #16]
+				0xeb3063ff, // cmp sp, x16
+				0x54000089, // b.ls morestack
+				0xa9bf7bfd, // stp x29, x30, [sp, #-16]!
+				0xd65f03c0, // ret
+				0xd503201f, // nop
+				0x94000000, // morestack: bl runtime.morestack
+				0x17fffff9, // b entry
+			),
+			trampolineLen: 4,
+			gate: le32(
+				0xf9400b90, // ldr x16, [x28, #16]
+				0x17ffeff8, // b entry+4
+			),
+			patches: []patch{{addr: testSource + 0x1c, code: le32(0x14001001)}}, // b gate
+		},
+		{
+			name: "no stack check",
+			code: le32(
+				0xd10043ff, // sub sp, sp, #16
+				0xd65f03c0, // ret
+			),
+			trampolineLen: 4,
+			gate: le32(
+				0xd10043ff, // sub sp, sp, #16
+				0x17ffeff8, // b entry+4
+			),
+		},
+		{
+			name:          "pc-relative instruction",
+			code:          le32(0x90000000, 0xd65f03c0), // adrp x0, 0; ret
+			trampolineLen: 4,
+			expected:      ErrUnsupportedPrologue,
+		},
+		{
+			name:          "no return from morestack",
+			code:          le32(0xf9400b90, 0xd65f03c0), // ldr x16, [x28, #16]; ret
+			trampolineLen: 4,
+			expected:      ErrUnsupportedPrologue,
+		},
+		{
+			name:          "long trampoline",
+			code:          le32(0xd10043ff, 0xd65f03c0),
+			trampolineLen: 8,
+			expected:      ErrShortFunction,
+		},
+		{
+			name:          "short function",
+			code:          []byte{0x00, 0x00},
+			trampolineLen: 4,
+			expected:      ErrShortFunction,
+		},
+	} {
+		gate, patches, err := arm64{}.GenerateGate(&gosym.Func{Entry: testSource}, tc.code, testGate, tc.trampolineLen)
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+
+		if !bytes.Equal(gate, tc.gate) {
+			t.Errorf("%s: unexpected gate: % x, expected % x", tc.name, gate, tc.gate)
+		}
+
+		if !slices.EqualFunc(patches, tc.patches, equalPatch) {
+			t.Errorf("%s: unexpected patches: %x, expected %x", tc.name, patches, tc.patches)
+		}
+	}
+}
+
+func equalPatch(a, b patch) bool { return a.addr == b.addr && bytes.Equal(a.code, b.code) }
+
+// memoryExecutable is an Executable with text placed to memory.
+type memoryExecutable struct {
+	text []byte
+}
+
+func (e *memoryExecutable) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(e.text)) {
+		return 0, io.EOF
+	}
+
+	return copy(p, e.text[off:]), nil
+}
+
+func (e *memoryExecutable) WriteAt(p []byte, off int64) (int, error) {
+	return copy(e.text[off:], p), nil
+}
+
+func (*memoryExecutable) GOARCH() string           { return "amd64" }
+func (*memoryExecutable) TextAddr() uint64         { return testSource }
+func (*memoryExecutable) GoSymTabData() io.Reader  { return bytes.NewReader(nil) }
+func (*memoryExecutable) GoPCLnTabData() io.Reader { return bytes.NewReader(nil) }
+func (e *memoryExecutable) TextRanges() []Range {
+	return []Range{{Start: testSource, End: testSource + uint64(len(e.text))}}
+}
+func (*memoryExecutable) Offset(p *gosym.Func) (int64, error) {
+	return int64(p.Entry - testSource), nil
+}
+
+// newMemoryReplacer makes Replacer of amd64 executable with text of provided size beginning at testSource.
+func newMemoryReplacer(size int, funcs []gosym.Func, code map[uint64][]byte) (*Replacer, *memoryExecutable) {
+	executable := &memoryExecutable{text: make([]byte, size)}
+	for addr, c := range code {
+		copy(executable.text[addr-testSource:], c)
+	}
+
+	idx := make(map[string]gosym.Func, len(funcs))
+	for _, fn := range funcs {
+		idx[fn.Name] = fn
+	}
+
+	return &Replacer{
+		executable: executable,
+		generator:  amd64{},
+		gosymtab:   &gosym.Table{Funcs: funcs},
+		funcIdx:    idx,
+		text:       executable.TextRanges(),
+	}, executable
+}
+
+func TestHook(t *testing.T) {
+	source := []byte{
+		0x55,             // push rbp
+		0x48, 0x89, 0xe5, // mov rbp, rsp
+		0x48, 0x83, 0xec, 0x18, // sub rsp, 24
+		0xc3, // ret
+	}
+
+	r, executable := newMemoryReplacer(testPad+HookSize-testSource, []gosym.Func{
+		{Sym: &gosym.Sym{Name: "main.source"}, Entry: testSource, End: testSource + 0x10},
+		{Sym: &gosym.Sym{Name: "main.pad"}, Entry: testPad, End: testPad + HookSize},
+	}, map[uint64][]byte{testSource: source})
+
+	gate, err := r.Hook("main.source", 0x6000, testPad)
+	if err != nil {
+		t.Fatalf("Hook: %s", err)
+	}
+
+	if gate != testGate {
+		t.Errorf("Unexpected gate address: %#x", gate)
+	}
+
+	text := slices.Clone(executable.text)
+
+	for _, tc := range []struct {
+		name     string
+		addr     uint64
+		expected []byte
+	}{
+		{name: "trampoline", addr: testSource, expected: []byte{0xe9, 0xfb, 0x3f, 0x00, 0x00}}, // jmp pad
+		{name: "thunk", addr: testPad, expected: []byte{
+			0x48, 0x8b, 0x15, 0xf9, 0x0f, 0x00, 0x00, // mov rdx, [rip+0xff9]
+			0x48, 0x85, 0xd2, // test rdx, rdx
+			0x74, 0x02, // je gate
+			0xff, 0x22, // jmp [rdx]
+			0xe9, 0x0d, 0x00, 0x00, 0x00, // jmp gate
+		}},
+		{name: "gate", addr: testGate, expected: []byte{
+			0x55,             // push rbp
+			0x48, 0x89, 0xe5, // mov rbp, rsp
+			0x48, 0x83, 0xec, 0x18, // sub rsp, 24
+			0xe9, 0xdb, 0xbf, 0xff, 0xff, // jmp source+8
+		}},
+	} {
+		if code := text[tc.addr-testSource:][:len(tc.expected)]; !bytes.Equal(code, tc.expected) {
+			t.Errorf("Unexpected %s: % x, expected % x", tc.name, code, tc.expected)
+		}
+	}
+
+	// copy of patched executable hooked again
+	if gate, err = r.Hook("main.source", 0x6000, testPad); err != nil || gate != testGate {
+		t.Errorf("Unexpected result of repeated hook: %#x, %v", gate, err)
+	}
+
+	if !bytes.Equal(executable.text, text) {
+		t.Error("Repeated hook modified executable")
+	}
+}
+
+func TestHookErrors(t *testing.T) {
+	r, _ := newMemoryReplacer(testPad+HookSize-testSource, []gosym.Func{
+		{Sym: &gosym.Sym{Name: "main.source"}, Entry: testSource, End: testSource + 0x10},
+		{Sym: &gosym.Sym{Name: "main.unsupported"}, Entry: testSource + 0x10, End: testSource + 0x20},
+		{Sym: &gosym.Sym{Name: "main.pad"}, Entry: testPad, End: testPad + HookSize},
+	}, map[uint64][]byte{
+		testSource:        {0x55, 0x48, 0x89, 0xe5, 0x48, 0x83, 0xec, 0x18, 0xc3},
+		testSource + 0x10: {0x31, 0xc0, 0xc3}, // xor eax, eax; ret
+	})
+
+	if _, err := r.Hook("main.unknown", 0x6000, testPad); !errors.Is(err, ErrFunctionNotFound) {
+		t.Errorf("Unexpected error for unknown function: %v", err)
+	}
+
+	if _, err := r.Hook("main.unsupported", 0x6000, testPad); !errors.Is(err, ErrUnsupportedPrologue) {
+		t.Errorf("Unexpected error for unsupported prologue: %v", err)
+	}
+
+	if _, err := r.Hook("main.source", 0x6000, testPad+8); err == nil {
+		t.Error("Pad exceeding function accepted")
+	}
+
+	if _, err := r.Hook("main.source", 0x6000, 0x4000); err == nil {
+		t.Error("Pad outside of functions accepted")
+	}
+
+	if _, err := r.Hook("main.source", testPad+1<<32, testPad); !errors.Is(err, ErrLongDistance) {
+		t.Errorf("Unexpected error for far function value: %v", err)
+	}
+}
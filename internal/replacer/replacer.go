@@ -4,6 +4,7 @@ import (
 	"debug/gosym"
 	"fmt"
 	"io"
+	"sort"
 )
 
 var (
@@ -18,10 +19,25 @@ var (
 
 	// ErrLongDistance returned if functions located too far for trampoline.
 	ErrLongDistance = fmt.Errorf("long distance between functions")
+
+	// ErrCodeInjectionUnsupported returned if executable format doesn't support code injection.
+	ErrCodeInjectionUnsupported = fmt.Errorf("code injection unsupported for executable")
+
+	// ErrOutsideText returned if function is not located inside text sections of executable.
+	ErrOutsideText = fmt.Errorf("function outside of text sections")
+
+	// ErrRelocatedCode returned if code which should be overwritten is modified by loader.
+	ErrRelocatedCode = fmt.Errorf("code modified by dynamic relocation")
 )
 
+// Range is a range of virtual addresses: [Start, End).
+type Range struct {
+	Start, End uint64
+}
+
 // Executable contains methods to fetch information required for patching.
 type Executable interface {
+	io.ReaderAt
 	io.WriterAt
 
 	// GOARCH returns "GOARCH" string of executable.
@@ -30,6 +46,10 @@ type Executable interface {
 	// TextAddr returns 'text' (executable code) section address.
 	TextAddr() uint64
 
+	// TextRanges returns address ranges of all text sections. Large executables may contain several ones,
+	// the first one begins at TextAddr.
+	TextRanges() []Range
+
 	// GoSymTabData returns reader for 'gosymtab' section.
 	GoSymTabData() io.Reader
 
@@ -37,18 +57,37 @@ type Executable interface {
 	GoPCLnTabData() io.Reader
 
 	// Offset returns function offset from beginning of executable.
-	Offset(p *gosym.Func) int64
+	// Error returned if function is not located in executable file.
+	Offset(p *gosym.Func) (int64, error)
+}
+
+// CodeAppender may be implemented by Executable to support injection of new code.
+type CodeAppender interface {
+	// AppendCode places provided code to new executable segment and returns its virtual address.
+	AppendCode(code []byte) (uint64, error)
+}
+
+// Relocator may be implemented by Executable containing dynamic relocations applied by loader
+// (i.e. position-independent executables).
+type Relocator interface {
+	// Relocations returns address ranges modified by loader.
+	Relocations() ([]Range, error)
 }
 
 type trampolineGenerator interface {
 	GenerateTrampoline(source, target *gosym.Func) ([]byte, error)
 }
 
+// codeAlign is an alignment of injected code blobs.
+const codeAlign = 16
+
 type Replacer struct {
 	executable Executable
 	generator  trampolineGenerator
 	gosymtab   *gosym.Table
 	funcIdx    map[string]gosym.Func
+	text       []Range
+	relocated  []Range // sorted parts of text modified by loader
 }
 
 func NewReplacer(executable Executable) (*Replacer, error) {
@@ -77,14 +116,54 @@ func NewReplacer(executable Executable) (*Replacer, error) {
 		idx[fn.Name] = fn
 	}
 
+	text := executable.TextRanges()
+	if len(text) == 0 {
+		return nil, fmt.Errorf("no text sections")
+	}
+
+	relocated, err := relocatedText(executable, text)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Replacer{
 		executable: executable,
 		generator:  generator,
 		gosymtab:   gosymtab,
 		funcIdx:    idx,
+		text:       text,
+		relocated:  relocated,
 	}, nil
 }
 
+// relocatedText returns sorted ranges of text modified by loader. Go code is position-independent,
+// so usually there are no such ranges even in PIE.
+func relocatedText(executable Executable, text []Range) ([]Range, error) {
+	relocator, ok := executable.(Relocator)
+	if !ok {
+		return nil, nil
+	}
+
+	relocations, err := relocator.Relocations()
+	if err != nil {
+		return nil, fmt.Errorf("relocations read failed: %w", err)
+	}
+
+	var relocated []Range
+	for _, relocation := range relocations {
+		for _, t := range text {
+			if relocation.Start < t.End && relocation.End > t.Start {
+				relocated = append(relocated, relocation)
+				break
+			}
+		}
+	}
+
+	sort.Slice(relocated, func(i, j int) bool { return relocated[i].Start < relocated[j].Start })
+
+	return relocated, nil
+}
+
 // Replace puts "trampoline code" to beginning of function with sourceName that redirects to function with targetName.
 // Function names here are "raw" (no mangling, etc. performed before search).
 // There is no checks about "cyclic replacement" (i.e. "a"->"b" than "b"->"a") so be careful to avoid infinite loops.
@@ -99,18 +178,169 @@ func (r *Replacer) Replace(sourceName, targetName string) error {
 		return fmt.Errorf("target %s: %w", targetName, ErrFunctionNotFound)
 	}
 
-	trampoline, err := r.generator.GenerateTrampoline(&sourceFunc, &targetFunc)
+	return r.writeTrampoline(&sourceFunc, &targetFunc)
+}
+
+// ReplaceIndirect puts "trampoline code" to beginning of function with sourceName that calls function value
+// located at provided address like go calls closures. So replacement may be any function value of suitable type
+// placed to this address at runtime, including closures.
+// If fallbackName is not empty, function with such name called directly while function value is not set.
+// Not all architectures supported, ErrUnsupportedArchitecture returned for them.
+func (r *Replacer) ReplaceIndirect(sourceName string, funcValueAddr uint64, fallbackName string) error {
+	generator, ok := r.generator.(indirectTrampolineGenerator)
+	if !ok {
+		return ErrUnsupportedArchitecture
+	}
+
+	sourceFunc, ok := r.funcIdx[sourceName]
+	if !ok {
+		return fmt.Errorf("source %s: %w", sourceName, ErrFunctionNotFound)
+	}
+
+	var fallback *gosym.Func
+	if fallbackName != "" {
+		fallbackFunc, ok := r.funcIdx[fallbackName]
+		if !ok {
+			return fmt.Errorf("fallback %s: %w", fallbackName, ErrFunctionNotFound)
+		}
+
+		fallback = &fallbackFunc
+	}
+
+	trampoline, err := generator.GenerateIndirectTrampoline(&sourceFunc, funcValueAddr, fallback)
 	if err != nil {
 		return err
 	}
+
+	return r.write(&sourceFunc, trampoline)
+}
+
+// Entry returns address of function with provided name.
+func (r *Replacer) Entry(name string) (uint64, error) {
+	fn, ok := r.funcIdx[name]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", name, ErrFunctionNotFound)
+	}
+
+	return fn.Entry, nil
+}
+
+// Region returns address of function with provided name which is at least size bytes long.
+// It's useful to find functions implemented in assembly because they share names with their ABI wrappers.
+func (r *Replacer) Region(name string, size uint64) (uint64, error) {
+	for _, fn := range r.gosymtab.Funcs {
+		if fn.Name == name && fn.End-fn.Entry >= size {
+			return fn.Entry, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s of %d bytes: %w", name, size, ErrFunctionNotFound)
+}
+
+// Inject places provided code blobs to new executable segment and puts "trampoline code" to beginning of functions
+// (map keys) that redirects to corresponding code blob (map values).
+// Code blob called like original function, so it must follow go ABI for original function and return by itself.
+// Executable must implement CodeAppender, otherwise ErrCodeInjectionUnsupported returned.
+func (r *Replacer) Inject(code map[string][]byte) error {
+	appender, ok := r.executable.(CodeAppender)
+	if !ok {
+		return ErrCodeInjectionUnsupported
+	}
+
+	sourceNames := make([]string, 0, len(code))
+	for sourceName := range code {
+		if _, ok := r.funcIdx[sourceName]; !ok {
+			return fmt.Errorf("source %s: %w", sourceName, ErrFunctionNotFound)
+		}
+
+		sourceNames = append(sourceNames, sourceName)
+	}
+
+	sort.Strings(sourceNames)
+
+	var (
+		segment []byte
+		offsets = make(map[string]uint64, len(code))
+	)
+
+	for _, sourceName := range sourceNames {
+		for len(segment)%codeAlign != 0 {
+			segment = append(segment, 0)
+		}
+
+		offsets[sourceName] = uint64(len(segment))
+		segment = append(segment, code[sourceName]...)
+	}
+
+	addr, err := appender.AppendCode(segment)
+	if err != nil {
+		return fmt.Errorf("append code: %w", err)
+	}
+
+	for _, sourceName := range sourceNames {
+		sourceFunc := r.funcIdx[sourceName]
+
+		if err = r.writeTrampoline(&sourceFunc, &gosym.Func{Entry: addr + offsets[sourceName]}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Replacer) writeTrampoline(sourceFunc, targetFunc *gosym.Func) error {
+	trampoline, err := r.generator.GenerateTrampoline(sourceFunc, targetFunc)
+	if err != nil {
+		return err
+	}
+
+	return r.write(sourceFunc, trampoline)
+}
+
+func (r *Replacer) write(sourceFunc *gosym.Func, trampoline []byte) error {
+	if err := r.checkText(sourceFunc); err != nil {
+		return err
+	}
+
 	if uint64(len(trampoline)) > (sourceFunc.End - sourceFunc.Entry) {
 		return ErrShortFunction
 	}
 
-	_, err = r.executable.WriteAt(trampoline, r.executable.Offset(&sourceFunc))
-	if err != nil {
+	if err := r.writeAt(trampoline, sourceFunc.Entry); err != nil {
 		return fmt.Errorf("write trampoline: %w", err)
 	}
 
 	return nil
 }
+
+// checkText checks that function is located inside one of text sections.
+func (r *Replacer) checkText(fn *gosym.Func) error {
+	for _, text := range r.text {
+		if fn.Entry >= text.Start && fn.End <= text.End {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s at %#x: %w", fn.Name, fn.Entry, ErrOutsideText)
+}
+
+// writeAt writes code to executable at provided virtual address.
+func (r *Replacer) writeAt(code []byte, addr uint64) error {
+	end := addr + uint64(len(code))
+
+	// ranges may overlap, so check all of them beginning before end of code
+	for _, relocation := range r.relocated[:sort.Search(len(r.relocated), func(i int) bool { return r.relocated[i].Start >= end })] {
+		if relocation.End > addr {
+			return fmt.Errorf("%w at %#x", ErrRelocatedCode, relocation.Start)
+		}
+	}
+
+	offset, err := r.executable.Offset(&gosym.Func{Entry: addr})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.executable.WriteAt(code, offset)
+
+	return err
+}
@@ -0,0 +1,29 @@
+package replacer
+
+import (
+	"debug/gosym"
+	"errors"
+	"testing"
+)
+
+func TestReplaceErrors(t *testing.T) {
+	r, _ := newMemoryReplacer(0x10, []gosym.Func{
+		{Sym: &gosym.Sym{Name: "main.short"}, Entry: testSource, End: testSource + 4},
+		{Sym: &gosym.Sym{Name: "main.near"}, Entry: testSource + 4, End: testSource + 0x10},
+		{Sym: &gosym.Sym{Name: "main.far"}, Entry: testSource + 1<<33, End: testSource + 1<<33 + 0x10},
+	}, nil)
+
+	for _, tc := range []struct {
+		source, target string
+		expected       error
+	}{
+		{source: "main.short", target: "main.near", expected: ErrShortFunction},
+		{source: "main.near", target: "main.far", expected: ErrLongDistance},
+		{source: "main.near", target: "main.unknown", expected: ErrFunctionNotFound},
+		{source: "main.unknown", target: "main.near", expected: ErrFunctionNotFound},
+	} {
+		if err := r.Replace(tc.source, tc.target); !errors.Is(err, tc.expected) {
+			t.Errorf("%s -> %s: unexpected error: %v", tc.source, tc.target, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package replacer
 import (
 	"debug/gosym"
 	"encoding/binary"
+	"fmt"
 	"math"
 )
 
@@ -147,6 +148,38 @@ func (riscv) GenerateTrampoline(source, target *gosym.Func) ([]byte, error) {
 	return ret, nil
 }
 
+type ppc64 struct{}
+
+func (ppc64) GenerateTrampoline(source, target *gosym.Func) ([]byte, error) {
+	// signed 24-bit word offset, so at most 32MB in each direction
+	if distance(source, target)>>2 > immediate24bit>>1 {
+		return nil, ErrLongDistance
+	}
+
+	to := uint32(target.Entry - source.Entry)
+
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, 0x48000000|to&0x3fffffc) // b to
+
+	return ret, nil
+}
+
+type ppc64le struct{}
+
+func (ppc64le) GenerateTrampoline(source, target *gosym.Func) ([]byte, error) {
+	// signed 24-bit word offset, so at most 32MB in each direction
+	if distance(source, target)>>2 > immediate24bit>>1 {
+		return nil, ErrLongDistance
+	}
+
+	to := uint32(target.Entry - source.Entry)
+
+	ret := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ret, 0x48000000|to&0x3fffffc) // b to
+
+	return ret, nil
+}
+
 func distance(source, target *gosym.Func) uint64 {
 	if target.Entry > source.Entry {
 		return target.Entry - source.Entry
@@ -158,8 +191,10 @@ func distance(source, target *gosym.Func) uint64 {
 func trampolineFromGOARCH(goarch string) (trampolineGenerator, error) {
 	switch goarch {
 	// x86
-	case "amd64", "386":
-		return x86{}, nil
+	case "amd64":
+		return amd64{}, nil
+	case "386":
+		return i386{}, nil
 	// arm
 	case "arm":
 		return arm{}, nil
@@ -177,8 +212,124 @@ func trampolineFromGOARCH(goarch string) (trampolineGenerator, error) {
 	// riscv
 	case "riscv", "riscv64":
 		return riscv{}, nil
+	// power
+	case "ppc64":
+		return ppc64{}, nil
+	case "ppc64le":
+		return ppc64le{}, nil
 	// TODO: other architectures
 	default:
 		return nil, ErrUnsupportedArchitecture
 	}
 }
+
+// indirectTrampolineGenerator generates trampolines that call function value located at provided address
+// like go calls closures: pointer to function value loaded to "closure context" register and code pointer
+// loaded from function value is called.
+// If fallback provided, trampoline jumps to it directly while function value is not set.
+type indirectTrampolineGenerator interface {
+	GenerateIndirectTrampoline(source *gosym.Func, funcValueAddr uint64, fallback *gosym.Func) ([]byte, error)
+}
+
+// appendFallback appends direct jump to fallback (if provided) to the end of trampoline.
+func appendFallback(g trampolineGenerator, source *gosym.Func, trampoline []byte, fallback *gosym.Func) ([]byte, error) {
+	if fallback == nil {
+		return trampoline, nil
+	}
+
+	jump, err := g.GenerateTrampoline(&gosym.Func{Entry: source.Entry + uint64(len(trampoline))}, fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(trampoline, jump...), nil
+}
+
+func (g x86) GenerateIndirectTrampoline(source *gosym.Func, funcValueAddr uint64, fallback *gosym.Func) ([]byte, error) {
+	rel := int64(funcValueAddr - (source.Entry + 7))
+	if rel < math.MinInt32 || rel > math.MaxInt32 {
+		return nil, ErrLongDistance
+	}
+
+	ret := make([]byte, 7, 19)
+	ret[0], ret[1], ret[2] = 0x48, 0x8b, 0x15 // mov rdx, [rip+rel]
+	binary.LittleEndian.PutUint32(ret[3:], uint32(rel))
+	if fallback != nil {
+		ret = append(ret,
+			0x48, 0x85, 0xd2, // test rdx, rdx
+			0x74, 0x02, // je fallback
+		)
+	}
+	ret = append(ret, 0xff, 0x22) // jmp [rdx]
+
+	return appendFallback(g, source, ret, fallback)
+}
+
+type i386 struct{ x86 }
+
+func (g i386) GenerateIndirectTrampoline(source *gosym.Func, funcValueAddr uint64, fallback *gosym.Func) ([]byte, error) {
+	// there is no eip-relative addressing, so address of function value calculated relative to
+	// address of instruction following call: executable may be loaded at address other than specified in file (PIE)
+	rel := uint32(funcValueAddr - (source.Entry + 5))
+
+	ret := make([]byte, 12, 23)
+	ret[0] = 0xe8               // call next
+	ret[5] = 0x5a               // next: pop edx
+	ret[6], ret[7] = 0x8b, 0x92 // mov edx, [edx+rel]
+	binary.LittleEndian.PutUint32(ret[8:], rel)
+	if fallback != nil {
+		ret = append(ret,
+			0x85, 0xd2, // test edx, edx
+			0x74, 0x02, // je fallback
+		)
+	}
+	ret = append(ret, 0xff, 0x22) // jmp [edx]
+
+	return appendFallback(g, source, ret, fallback)
+}
+
+func (g arm64) GenerateIndirectTrampoline(source *gosym.Func, funcValueAddr uint64, fallback *gosym.Func) ([]byte, error) {
+	const (
+		regCtxt = 26 // closure context register
+		regTmp  = 27
+	)
+
+	if funcValueAddr&0x7 != 0 {
+		return nil, fmt.Errorf("unaligned function value address %#x", funcValueAddr)
+	}
+
+	pages := int64(funcValueAddr>>12) - int64(source.Entry>>12)
+	if pages < -(1<<20) || pages >= 1<<20 {
+		return nil, ErrLongDistance
+	}
+
+	instrs := []uint32{
+		0x90000000 | uint32(pages&0x3)<<29 | uint32(pages>>2&0x7ffff)<<5 | regCtxt, // adrp x26, page
+		0xf9400000 | uint32(funcValueAddr&0xfff)/8<<10 | regCtxt<<5 | regCtxt,      // ldr x26, [x26, #pageoff]
+	}
+	if fallback != nil {
+		instrs = append(instrs, 0xb4000000|3<<5|regCtxt) // cbz x26, fallback
+	}
+	instrs = append(instrs,
+		0xf9400000|regCtxt<<5|regTmp, // ldr x27, [x26]
+		0xd61f0000|regTmp<<5,         // br x27
+	)
+
+	ret := make([]byte, 4*len(instrs))
+	for i, instr := range instrs {
+		binary.LittleEndian.PutUint32(ret[4*i:], instr)
+	}
+
+	return appendFallback(g, source, ret, fallback)
+}
+
+// SupportsIndirect reports whether ReplaceIndirect supported for architecture.
+func SupportsIndirect(goarch string) bool {
+	generator, err := trampolineFromGOARCH(goarch)
+	if err != nil {
+		return false
+	}
+
+	_, ok := generator.(indirectTrampolineGenerator)
+	return ok
+}
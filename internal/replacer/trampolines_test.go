@@ -0,0 +1,182 @@
+package replacer
+
+import (
+	"bytes"
+	"debug/gosym"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// le32 encodes instructions of fixed-width instruction sets.
+func le32(instrs ...uint32) []byte {
+	ret := make([]byte, 0, 4*len(instrs))
+	for _, instr := range instrs {
+		ret = binary.LittleEndian.AppendUint32(ret, instr)
+	}
+
+	return ret
+}
+
+func TestGenerateTrampoline(t *testing.T) {
+	for _, tc := range []struct {
+		goarch         string
+		source, target uint64
+		expected       []byte
+		err            error
+	}{
+		{goarch: "amd64", source: 0x1000, target: 0x2000, expected: []byte{0xe9, 0xfb, 0x0f, 0x00, 0x00}},
+		{goarch: "amd64", source: 0x2000, target: 0x1000, expected: []byte{0xe9, 0xfb, 0xef, 0xff, 0xff}},
+		{goarch: "amd64", source: 0, target: 1 << 32, err: ErrLongDistance},
+		{goarch: "386", source: 0x1000, target: 0x2000, expected: []byte{0xe9, 0xfb, 0x0f, 0x00, 0x00}},
+		{goarch: "arm", source: 0x1000, target: 0x2000, expected: []byte{0xfe, 0x03, 0x00, 0xea}},
+		{goarch: "arm", source: 0, target: 1 << 24, err: ErrLongDistance},
+		{goarch: "armbe", source: 0x1000, target: 0x2000, expected: []byte{0xea, 0x00, 0x03, 0xfe}},
+		{goarch: "arm64", source: 0x1000, target: 0x2000, expected: le32(0x14000400)},
+		{goarch: "arm64", source: 0x2000, target: 0x1000, expected: le32(0x17fffc00)},
+		{goarch: "arm64", source: 0, target: 1 << 28, err: ErrLongDistance},
+		{goarch: "mipsle", source: 0x1000, target: 0x2000, expected: le32(0x08000800)},
+		{goarch: "mips64", source: 0x1000, target: 0x2000, expected: []byte{0x08, 0x00, 0x08, 0x00}},
+		{goarch: "mips", source: 0, target: 1 << 26, err: ErrLongDistance},
+		{goarch: "riscv64", source: 0x1000, target: 0x2000, expected: le32(0x0000106f)},
+		{goarch: "riscv64", source: 0x1000, target: 0x1802, expected: le32(0x0030006f)},
+		{goarch: "riscv64", source: 0, target: 1 << 21, err: ErrLongDistance},
+		{goarch: "ppc64", source: 0x1000, target: 0x2000, expected: []byte{0x48, 0x00, 0x10, 0x00}},
+		{goarch: "ppc64le", source: 0x1000, target: 0x2000, expected: le32(0x48001000)},
+		{goarch: "ppc64le", source: 0x2000, target: 0x1000, expected: le32(0x4bfff000)},
+		{goarch: "ppc64", source: 0, target: 1 << 25, err: ErrLongDistance},
+	} {
+		generator, err := trampolineFromGOARCH(tc.goarch)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.goarch, err)
+		}
+
+		trampoline, err := generator.GenerateTrampoline(&gosym.Func{Entry: tc.source}, &gosym.Func{Entry: tc.target})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s %#x -> %#x: unexpected error: %v", tc.goarch, tc.source, tc.target, err)
+			continue
+		}
+
+		if !bytes.Equal(trampoline, tc.expected) {
+			t.Errorf("%s %#x -> %#x: unexpected trampoline: % x, expected % x",
+				tc.goarch, tc.source, tc.target, trampoline, tc.expected)
+		}
+	}
+}
+
+func TestGenerateIndirectTrampoline(t *testing.T) {
+	for _, tc := range []struct {
+		goarch        string
+		funcValueAddr uint64
+		fallback      *gosym.Func
+		expected      []byte
+		anyErr        bool
+		err           error
+	}{
+		{
+			goarch:        "amd64",
+			funcValueAddr: 0x3000,
+			expected: []byte{
+				0x48, 0x8b, 0x15, 0xf9, 0x1f, 0x00, 0x00, // mov rdx, [rip+0x1ff9]
+				0xff, 0x22, // jmp [rdx]
+			},
+		},
+		{
+			goarch:        "amd64",
+			funcValueAddr: 0x3000,
+			fallback:      &gosym.Func{Entry: 0x2000},
+			expected: []byte{
+				0x48, 0x8b, 0x15, 0xf9, 0x1f, 0x00, 0x00, // mov rdx, [rip+0x1ff9]
+				0x48, 0x85, 0xd2, // test rdx, rdx
+				0x74, 0x02, // je fallback
+				0xff, 0x22, // jmp [rdx]
+				0xe9, 0xed, 0x0f, 0x00, 0x00, // fallback: jmp 0x2000
+			},
+		},
+		{goarch: "amd64", funcValueAddr: 0x1000 + 1<<31 + 7, err: ErrLongDistance},
+		{
+			goarch:        "386",
+			funcValueAddr: 0x3000,
+			expected: []byte{
+				0xe8, 0x00, 0x00, 0x00, 0x00, // call next
+				0x5a,                               // next: pop edx
+				0x8b, 0x92, 0xfb, 0x1f, 0x00, 0x00, // mov edx, [edx+0x1ffb]
+				0xff, 0x22, // jmp [edx]
+			},
+		},
+		{
+			goarch:        "386",
+			funcValueAddr: 0x3000,
+			fallback:      &gosym.Func{Entry: 0x2000},
+			expected: []byte{
+				0xe8, 0x00, 0x00, 0x00, 0x00, // call next
+				0x5a,                               // next: pop edx
+				0x8b, 0x92, 0xfb, 0x1f, 0x00, 0x00, // mov edx, [edx+0x1ffb]
+				0x85, 0xd2, // test edx, edx
+				0x74, 0x02, // je fallback
+				0xff, 0x22, // jmp [edx]
+				0xe9, 0xe9, 0x0f, 0x00, 0x00, // fallback: jmp 0x2000
+			},
+		},
+		{
+			goarch:        "arm64",
+			funcValueAddr: 0x3008,
+			expected: le32(
+				0xd000001a, // adrp x26, 0x3000
+				0xf940075a, // ldr x26, [x26, #8]
+				0xf940035b, // ldr x27, [x26]
+				0xd61f0360, // br x27
+			),
+		},
+		{
+			goarch:        "arm64",
+			funcValueAddr: 0x3008,
+			fallback:      &gosym.Func{Entry: 0x2000},
+			expected: le32(
+				0xd000001a, // adrp x26, 0x3000
+				0xf940075a, // ldr x26, [x26, #8]
+				0xb400007a, // cbz x26, fallback
+				0xf940035b, // ldr x27, [x26]
+				0xd61f0360, // br x27
+				0x140003fb, // fallback: b 0x2000
+			),
+		},
+		{goarch: "arm64", funcValueAddr: 0x3004, anyErr: true},
+		{goarch: "arm64", funcValueAddr: 0x1000 + 1<<32, err: ErrLongDistance},
+	} {
+		generator, err := trampolineFromGOARCH(tc.goarch)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.goarch, err)
+		}
+
+		trampoline, err := generator.(indirectTrampolineGenerator).
+			GenerateIndirectTrampoline(&gosym.Func{Entry: 0x1000}, tc.funcValueAddr, tc.fallback)
+
+		switch {
+		case tc.anyErr:
+			if err == nil {
+				t.Errorf("%s %#x: error expected", tc.goarch, tc.funcValueAddr)
+			}
+
+			continue
+		case !errors.Is(err, tc.err):
+			t.Errorf("%s %#x: unexpected error: %v", tc.goarch, tc.funcValueAddr, err)
+			continue
+		}
+
+		if !bytes.Equal(trampoline, tc.expected) {
+			t.Errorf("%s %#x: unexpected trampoline: % x, expected % x", tc.goarch, tc.funcValueAddr, trampoline, tc.expected)
+		}
+	}
+}
+
+func TestSupportsIndirect(t *testing.T) {
+	for goarch, expected := range map[string]bool{
+		"amd64": true, "386": true, "arm64": true,
+		"arm": false, "ppc64le": false, "riscv64": false, "s390x": false,
+	} {
+		if supported := SupportsIndirect(goarch); supported != expected {
+			t.Errorf("%s: unexpected support of indirect trampolines: %t", goarch, supported)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package monkey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// manifestEnvVar is an environment variable used to pass applied replacements to patched executable.
+const manifestEnvVar = "XXX_MONKEY_MANIFEST"
+
+// Replacement describes function replacement applied to executable.
+type Replacement struct {
+	// Original is a name of replaced function.
+	Original string `json:"original"`
+
+	// Replacement is a name of function called instead of original.
+	// It's empty if original function replaced by raw code.
+	Replacement string `json:"replacement,omitempty"`
+
+	// Site is a place in code where replacement was registered in "file:line" form.
+	// It distinguishes replacements made by different patchers.
+	Site string `json:"site,omitempty"`
+}
+
+type manifest struct {
+	Executable   string           `json:"executable"` // see executableMarker
+	Replacements []Replacement    `json:"replacements"`
+	Slots        map[string]int   `json:"slots,omitempty"` // dispatch table slots, see assignSlots
+	Gates        map[string]int64 `json:"gates,omitempty"` // see makeDispatchedReplacements
+}
+
+// applied is a manifest passed by parent process. It's nil if we are not running patched executable.
+var applied = loadManifest()
+
+// applies reports whether replacement was applied to executable.
+func (m *manifest) applies(replacement Replacement) bool {
+	for _, r := range m.Replacements {
+		if r == replacement {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPatched reports whether code runs inside executable patched by PatchAndExec.
+func IsPatched() bool { return applied != nil }
+
+// AppliedReplacements returns replacements applied to current executable sorted by original function name.
+// It returns nil if code runs inside not patched executable.
+func AppliedReplacements() []Replacement {
+	if applied == nil {
+		return nil
+	}
+
+	return append([]Replacement(nil), applied.Replacements...)
+}
+
+func loadManifest() *manifest {
+	// os.LookupEnv may be replaced
+	data, ok := syscall.Getenv(manifestEnvVar)
+	if !ok {
+		return nil
+	}
+
+	var m manifest
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil
+	}
+
+	// manifest may be inherited from patched parent process, so check that it was made for us
+	myPath, err := os.Executable()
+	if err != nil || m.Executable != executableMarker(myPath) {
+		return nil
+	}
+
+	return &m
+}
+
+// executableMarker returns string bound to executable located at provided path.
+func executableMarker(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	sum := sha256.Sum256([]byte(path))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+func (p *Patcher) manifest() *manifest {
+	m := &manifest{Replacements: make([]Replacement, 0, len(p.replacements)+len(p.codeReplacements)+len(p.dispatched))}
+	for original, replacement := range p.replacements {
+		m.Replacements = append(m.Replacements, p.replacement(original, replacement))
+	}
+
+	for original := range p.codeReplacements {
+		m.Replacements = append(m.Replacements, p.replacement(original, ""))
+	}
+
+	for original, replacement := range p.dispatched {
+		m.Replacements = append(m.Replacements, p.replacement(original, replacement.replacementName()))
+	}
+
+	sort.Slice(m.Replacements, func(i, j int) bool {
+		return m.Replacements[i].Original < m.Replacements[j].Original
+	})
+
+	return m
+}
+
+// replacement describes registered replacement of original function. Must be called with mutex held.
+func (p *Patcher) replacement(original, replacement string) Replacement {
+	return Replacement{Original: original, Replacement: replacement, Site: p.registrations[original].site}
+}
+
+func (m *manifest) encode() (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// setEnv returns environment with variable set to provided value. Previous values of variable are removed.
+func setEnv(environ []string, name, value string) []string {
+	ret := make([]string, 0, len(environ)+1)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, name+"=") {
+			ret = append(ret, kv)
+		}
+	}
+
+	return append(ret, name+"="+value)
+}
@@ -1,10 +1,16 @@
 package monkey
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/xakep666/monkey/internal/executable"
 	"github.com/xakep666/monkey/internal/replacer"
@@ -26,18 +32,76 @@ var (
 
 	// ErrLongDistance returned if functions located too far for trampoline.
 	ErrLongDistance = replacer.ErrLongDistance
+
+	// ErrCodeInjectionUnsupported returned if code injection is not supported for executable format.
+	ErrCodeInjectionUnsupported = replacer.ErrCodeInjectionUnsupported
+
+	// ErrUnsupportedPrologue returned if beginning of function can't be moved to call original function
+	// after replacement (see Inject).
+	ErrUnsupportedPrologue = replacer.ErrUnsupportedPrologue
+
+	// ErrRelocatedCode returned if beginning of function is modified by loader, so trampoline can't be placed there.
+	ErrRelocatedCode = replacer.ErrRelocatedCode
+
+	// ErrResultsMismatch returned if provided values don't match function results.
+	ErrResultsMismatch = fmt.Errorf("results mismatch")
+
+	// ErrArgumentsMismatch returned if provided values don't match function parameters.
+	ErrArgumentsMismatch = fmt.Errorf("arguments mismatch")
+
+	// ErrTooManyReplacements returned if count of dispatched replacements exceeds dispatch table size.
+	ErrTooManyReplacements = fmt.Errorf("too many replacements")
+
+	// ErrCapturingClosure returned if closure replacement (function literal or method value) can't be called
+	// via dispatch table, i.e. for executables other than current one. Such replacement would be called without
+	// captured variables, use named function instead.
+	ErrCapturingClosure = fmt.Errorf("closure replacement can't be called via dispatch table")
+
+	// ErrCurrentExecutableOnly returned on attempt to apply replacement that works only in current executable
+	// (i.e. registered by Return) to other executable.
+	ErrCurrentExecutableOnly = fmt.Errorf("replacement may be applied only to current executable")
+
+	// ErrDuplicateReplacement returned if same function registered several times with same priority.
+	ErrDuplicateReplacement = fmt.Errorf("duplicate replacement")
+
+	// ErrReplacementsNotApplied returned by PatchAndExec inside patched executable if some of registered
+	// replacements were not applied. Usually this means that executable was patched by another Patcher.
+	ErrReplacementsNotApplied = fmt.Errorf("replacements were not applied")
+
+	// ErrSignedBinary returned if patched executable contains signature (i.e. Authenticode) which becomes invalid
+	// after patching. See StripSignatures.
+	ErrSignedBinary = executable.ErrSignedBinary
 )
 
-// Patcher is a registry of function replacements applied to executable
+// Patcher is a registry of function replacements applied to executable. It's safe for concurrent use.
 type Patcher struct {
-	replacements map[string]string // original function name to new function name
-	stickyErr    error
+	mu               sync.Mutex
+	replacements     map[string]string                // original function name to new function name
+	codeReplacements map[string][]byte                // original function name to injected code
+	dispatched       map[string]dispatchedReplacement // original function name to replacement called via dispatch table
+	registrations    map[string]registration          // original function name to registration info
+	mocks            map[string]*mock                 // original function name to mock made by Mock or Expect
+	verifying        map[TestingT]struct{}            // tests which verify mocks on cleanup
+	stickyErr        error
+	patcherOptions
+}
+
+// registration contains information about replacement registration used to resolve conflicts.
+type registration struct {
+	registerOptions
+	site string // place in code where replacement was registered
 }
 
 // NewPatcher constructs Patcher.
-func NewPatcher() *Patcher {
+func NewPatcher(opts ...PatcherOption) *Patcher {
 	return &Patcher{
-		replacements: map[string]string{},
+		patcherOptions:   newPatcherOptions(opts...),
+		replacements:     map[string]string{},
+		codeReplacements: map[string][]byte{},
+		dispatched:       map[string]dispatchedReplacement{},
+		registrations:    map[string]registration{},
+		mocks:            map[string]*mock{},
+		verifying:        map[TestingT]struct{}{},
 	}
 }
 
@@ -48,34 +112,182 @@ func (p *Patcher) Apply(cb func(patcher *Patcher)) *Patcher {
 }
 
 // RegisterReplacement registers function replacement in patcher.
+// If same function registered several times, conflict resolved according to options (see WithPriority, WithOverride).
+// Replacement may be a closure (function literal or method value) capturing variables. On architectures
+// supporting dispatch table (currently amd64, 386 and arm64) such replacements called via dispatch table
+// so captured variables are available, ErrCapturingClosure returned if it's impossible (i.e. by PatchFile).
+// On other architectures closures called directly, so they must not capture anything.
 // Defined as function because it's impossible to use different type parameters in methods.
 // Note that arguments must be functions despite "any" used as constraint
-//	because generics doesn't allow to specify that parameter must be "any function".
-func RegisterReplacement[T any](p *Patcher, original, replacement T) {
+// because generics doesn't allow to specify that parameter must be "any function".
+func RegisterReplacement[T any](p *Patcher, original, replacement T, opts ...RegisterOption) {
+	registerReplacement(p, original, replacement, registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	})
+}
+
+func registerReplacement[T any](p *Patcher, original, replacement T, reg registration) {
 	originalValue := reflect.ValueOf(original)
 	replacementValue := reflect.ValueOf(replacement)
 
 	if originalValue.Kind() != reflect.Func || replacementValue.Kind() != reflect.Func {
-		p.stickyErr = ErrFunctionNotFound
+		p.fail(ErrFunctionNotFound)
 		return
 	}
 
 	originalFunc := runtime.FuncForPC(uintptr(originalValue.UnsafePointer()))
+	if originalFunc == nil {
+		p.fail(ErrFunctionNotFound)
+		return
+	}
+
+	p.registerNamed(originalFunc.Name(), replacementValue, reg)
+}
+
+// RegisterNamedReplacement registers replacement of function with provided name.
+// It's useful for functions which can't be referenced directly, i.e. unexported ones.
+// Replacement must be a function with same signature as original, it's not checked.
+// See RegisterReplacement for details.
+func (p *Patcher) RegisterNamedReplacement(original string, replacement any, opts ...RegisterOption) {
+	replacementValue := reflect.ValueOf(replacement)
+	if replacementValue.Kind() != reflect.Func {
+		p.fail(ErrFunctionNotFound)
+		return
+	}
+
+	p.registerNamed(original, replacementValue, registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	})
+}
+
+// RegisterNamedReplacementByName registers replacement of function with provided name by function with another name.
+// It's useful if replacement is not linked into current executable (see PatchFile and OpenPlugin).
+// Both functions must be present in patched executable and have same signature, it's not checked.
+// See RegisterReplacement for details.
+func (p *Patcher) RegisterNamedReplacementByName(original, replacement string, opts ...RegisterOption) {
+	p.register(original, registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}, func() {
+		p.replacements[original] = replacement
+	})
+}
+
+func (p *Patcher) registerNamed(original string, replacementValue reflect.Value, reg registration) {
 	replacementFunc := runtime.FuncForPC(uintptr(replacementValue.UnsafePointer()))
+	if replacementFunc == nil {
+		p.fail(ErrFunctionNotFound)
+		return
+	}
 
-	if originalFunc == nil || replacementFunc == nil {
-		p.stickyErr = ErrFunctionNotFound
+	if isClosure(replacementFunc.Name()) && dispatchSupported() {
+		p.registerDispatched(original, dispatchedReplacement{
+			value: replacementValue,
+			name:  replacementFunc.Name(),
+		}, reg)
 		return
 	}
 
-	p.replacements[originalFunc.Name()] = replacementFunc.Name()
+	p.register(original, reg, func() {
+		p.replacements[original] = replacementFunc.Name()
+	})
+}
+
+// RegisterCodeReplacement registers replacement of function with provided name by raw machine code.
+// Code will be placed to new executable segment, so it's useful to inject behaviour into executables
+// that don't contain suitable replacement function (see PatchFile and Command).
+// Code called like original function, so it must be position-independent, follow go ABI of original function
+// and return by itself.
+// Code is injected only into ELF executables (i.e. Linux and FreeBSD ones). Target executable is not known
+// at registration time, so for Mach-O, PE and XCOFF executables and WebAssembly modules PatchAndExec, PatchFile
+// and Command return ErrCodeInjectionUnsupported before any function is patched.
+func (p *Patcher) RegisterCodeReplacement(original string, code []byte, opts ...RegisterOption) {
+	code = append([]byte(nil), code...)
+
+	p.register(original, registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}, func() {
+		p.codeReplacements[original] = code
+	})
+}
+
+// register resolves conflicts with previous registrations of original function and
+// calls set (with mutex held) if new registration wins.
+func (p *Patcher) register(original string, reg registration, set func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.registrations[original]; ok {
+		switch {
+		case reg.override || reg.priority > prev.priority:
+			// new registration wins
+		case reg.priority < prev.priority:
+			return
+		default:
+			p.stickyErr = fmt.Errorf("%w: %s registered at %s and %s", ErrDuplicateReplacement, original, prev.site, reg.site)
+			return
+		}
+	}
+
+	p.forget(original)
+	p.registrations[original] = reg
+	set()
+}
+
+// fail sets error returned on patching.
+func (p *Patcher) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stickyErr = err
+}
+
+// forget removes all registered replacements of original function. Must be called with mutex held.
+func (p *Patcher) forget(original string) {
+	delete(p.replacements, original)
+	delete(p.codeReplacements, original)
+	delete(p.dispatched, original)
+}
+
+// callerSite returns location of caller in "file:line" form. Argument is a number of stack frames to skip
+// above caller of callerSite.
+func callerSite(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+func funcName(fn reflect.Value) (string, bool) {
+	f := runtime.FuncForPC(fn.Pointer())
+	if f == nil {
+		return "", false
+	}
+
+	return f.Name(), true
 }
 
 func (p *Patcher) detectCyclicReplacements() error {
+	replacements := make(map[string]string, len(p.replacements)+len(p.dispatched))
+	for original, replacement := range p.replacements {
+		replacements[original] = replacement
+	}
+
+	for original, replacement := range p.dispatched {
+		if replacement.name != "" {
+			replacements[original] = replacement.name
+		}
+	}
+
 	visitedAll := make(map[string]struct{})
 	queue := make([]string, 0)
 
-	for original := range p.replacements {
+	for original := range replacements {
 		if _, ok := visitedAll[original]; ok {
 			continue // already checked this chain
 		}
@@ -87,7 +299,7 @@ func (p *Patcher) detectCyclicReplacements() error {
 			visitedAll[queue[i]] = struct{}{}
 			visited[queue[i]] = struct{}{}
 
-			replacement, ok := p.replacements[queue[i]]
+			replacement, ok := replacements[queue[i]]
 			if !ok {
 				continue // no replacement registered
 			}
@@ -103,23 +315,123 @@ func (p *Patcher) detectCyclicReplacements() error {
 	return nil
 }
 
-func (p *Patcher) makeReplacements(rw executable.ReadWriterAt) error {
+// makeReplacements makes patches in executable. Slots of dispatch table must be provided only if current executable
+// patched, see assignSlots. Gates of hooked replacements returned, see makeDispatchedReplacements.
+func (p *Patcher) makeReplacements(rw executable.ReadWriterAt, slots map[string]int) (map[string]int64, error) {
 	if err := p.detectCyclicReplacements(); err != nil {
-		return err
+		return nil, err
 	}
 
-	exe, err := executable.Recognize(rw)
+	if slots != nil {
+		exe, err := executable.Recognize(rw)
+		if err != nil {
+			return nil, err
+		}
+
+		return p.patchExecutable(exe, slots)
+	}
+
+	// webassembly modules can't be patched by trampolines
+	var notGo executable.ErrNotGo
+	if module, err := executable.NewWASM(rw); err == nil {
+		return nil, p.patchWASM(module)
+	} else if errors.As(err, &notGo) {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+
+	// executable may be run on other machine, so all slices of universal binary patched
+	exes, err := executable.RecognizeAll(rw)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	for _, exe := range exes {
+		if _, err = p.patchExecutable(exe, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// patchExecutable makes patches in recognized executable, see makeReplacements.
+func (p *Patcher) patchExecutable(exe replacer.Executable, slots map[string]int) (map[string]int64, error) {
+	if _, ok := exe.(replacer.CodeAppender); !ok && len(p.codeReplacements) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCodeInjectionUnsupported, formatName(exe))
+	}
+
+	if signed, ok := exe.(executable.Signed); ok && signed.Signed() {
+		if !p.stripSignatures {
+			return nil, fmt.Errorf("%w (use StripSignatures option to patch anyway)", ErrSignedBinary)
+		}
+
+		if err := signed.StripSignature(); err != nil {
+			return nil, err
+		}
 	}
 
 	r, err := replacer.NewReplacer(exe)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for originalName, replacementName := range p.replacements {
 		if err = r.Replace(originalName, replacementName); err != nil {
+			return nil, err
+		}
+	}
+
+	gates, err := p.makeDispatchedReplacements(r, slots)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.codeReplacements) > 0 {
+		if err = r.Inject(p.codeReplacements); err != nil {
+			return nil, err
+		}
+	}
+
+	return gates, nil
+}
+
+// formatName returns human-readable name of executable format.
+func formatName(exe replacer.Executable) string {
+	switch exe.(type) {
+	case *executable.ELF:
+		return "ELF"
+	case *executable.MachO:
+		return "Mach-O"
+	case *executable.PE:
+		return "PE"
+	case *executable.XCOFF:
+		return "XCOFF"
+	default:
+		return fmt.Sprintf("%T", exe)
+	}
+}
+
+// patchWASM makes patches in webassembly module. Bodies of original functions replaced by calls of replacements,
+// so only replacements by functions present in module supported.
+func (p *Patcher) patchWASM(module *executable.WASM) error {
+	if len(p.codeReplacements) > 0 {
+		return fmt.Errorf("%w: WebAssembly", ErrCodeInjectionUnsupported)
+	}
+
+	// dispatch table exists only in current executable, even named closures can't be called without it
+	if len(p.dispatched) > 0 {
+		originals := make([]string, 0, len(p.dispatched))
+		for original := range p.dispatched {
+			originals = append(originals, original)
+		}
+
+		sort.Strings(originals)
+
+		return fmt.Errorf("%s: %w", strings.Join(originals, ", "), ErrCurrentExecutableOnly)
+	}
+
+	for originalName, replacementName := range p.replacements {
+		if err := module.Replace(originalName, replacementName); err != nil {
 			return err
 		}
 	}
@@ -130,19 +442,25 @@ func (p *Patcher) makeReplacements(rw executable.ReadWriterAt) error {
 // PatchAndExec makes patches according to registered replacements and re-runs executable.
 // Algorithm:
 // 0) Check if we are not running patched executable, otherwise go to 1.
-// This made by checking presence (or exact value if specified) of special environment variable.
-// 0.1) Remove itself if such option specified.
+// This made by checking value of special environment variable. By default, value is bound to patched executable
+// so other executables started by patched one will not be affected. Exact value may be specified by option.
+// 0.1) Remove variable from environment unless KeepEnvVar option specified.
+// 0.2) Remove itself if such option specified.
 // 1) Copy current executable to temporary file
 // 2) For each replacement: replace beginning of original function with "trampoline" to replacement function.
 // 3) Run patched executable with special environment variable to avoid recursions (this is terminal condition).
+// List of applied replacements passed too, see IsPatched and AppliedReplacements.
 // 'execve' system call used on *nix systems, 'exec.Command' with stdin/out/err attached and 'os.Exit' after termination on others.
 // So on successful run all code after this function in original executable will become unreachable.
 func (p *Patcher) PatchAndExec(opts ...PatchAndExecOption) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.stickyErr != nil {
 		return p.stickyErr
 	}
 
-	settings := patchAndExecOptions{envVarName: "XXX_REPLACED"}
+	settings := patchAndExecOptions{envVarName: defaultEnvVarName}
 	settings.applyAll(opts...)
 
 	myPath, err := os.Executable()
@@ -150,34 +468,198 @@ func (p *Patcher) PatchAndExec(opts ...PatchAndExecOption) error {
 		return fmt.Errorf("get executable path: %w", err)
 	}
 
-	if os.Getenv(settings.envVarName) != settings.envVarValue {
+	envVarValue := settings.envVarValue
+	if envVarValue == "" {
+		envVarValue = executableMarker(myPath)
+	}
+
+	// os.Getenv may be replaced
+	if value, _ := syscall.Getenv(settings.envVarName); value == envVarValue {
+		if !settings.keepEnvVar {
+			_ = os.Unsetenv(settings.envVarName)
+			_ = os.Unsetenv(manifestEnvVar)
+		}
+
 		if settings.removePatched {
 			_ = os.Remove(myPath)
 		}
 
-		return nil
+		return p.checkApplied()
+	}
+
+	slots, err := p.assignSlots()
+	if err != nil {
+		return err
+	}
+
+	tmpPath, gates, err := p.patchToTemp(myPath, slots)
+	if err != nil {
+		return err
+	}
+
+	m := p.manifest()
+	m.Slots = slots
+	m.Gates = gates
+	m.Executable = executableMarker(tmpPath)
+
+	envVarValue = settings.envVarValue
+	if envVarValue == "" {
+		envVarValue = m.Executable
 	}
 
-	tmp, err := copyToTemp(myPath)
+	manifestData, err := m.encode()
 	if err != nil {
-		return fmt.Errorf("copy to temp file: %w", err)
+		return fmt.Errorf("encode manifest: %w", err)
 	}
 
-	tmpPath := tmp.Name()
+	environ := setEnv(os.Environ(), settings.envVarName, envVarValue)
+	environ = setEnv(environ, manifestEnvVar, manifestData)
+
+	return execWithEnv(tmpPath, environ)
+}
+
+// PatchFile copies executable from src to dst and makes patches in dst according to registered replacements.
+// Unlike PatchAndExec it may be used for any go executable, not only for the current one.
+// Note that replacements are looked up by function names, so both original and replacement functions
+// must be present in patched executable. All slices of universal (fat) Mach-O binary are patched.
+// Patched copy is prepared in directory of dst and renamed to dst on success, so dst is left untouched
+// if patching failed. Src and dst must be different files.
+func (p *Patcher) PatchFile(src, dst string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	if err = p.makeReplacements(tmp); err != nil {
+	if p.stickyErr != nil {
+		return p.stickyErr
+	}
+
+	same, err := sameFile(src, dst)
+	if err != nil {
 		return err
 	}
 
+	if same {
+		return fmt.Errorf("%s and %s are the same file", src, dst)
+	}
+
+	f, err := copyToSibling(src, dst)
+	if err != nil {
+		return fmt.Errorf("copy to %s: %w", dst, err)
+	}
+
+	tmpPath := f.Name()
+
+	if err = p.patchFile(f); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err = os.Rename(tmpPath, dst); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("rename to %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+func (p *Patcher) patchFile(f *os.File) error {
+	defer f.Close()
+
+	if _, err := p.makeReplacements(f, nil); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Command returns exec.Cmd to run patched copy of executable located at path with provided arguments.
+// Copy placed to temporary directory and patched like in PatchFile, so same restrictions applied.
+// Applied replacements passed to started process, see IsPatched and AppliedReplacements.
+// Errors occurred during patching returned on command start like exec.Command does, in this case Cmd.Path is empty.
+// Started process is marked as patched like PatchAndExec does with default options, so PatchAndExec called there
+// doesn't patch executable again, it just checks that its replacements were applied.
+// Caller is responsible for removal of patched executable (available as Cmd.Path) after command finish
+// if Cmd.Err is nil.
+func (p *Patcher) Command(path string, args ...string) *exec.Cmd {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tmpPath, _, err := p.patchToTemp(path, nil)
+	if err != nil {
+		return failedCommand(path, args, err)
+	}
+
+	m := p.manifest()
+	m.Executable = executableMarker(tmpPath)
+
+	manifestData, err := m.encode()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return failedCommand(path, args, fmt.Errorf("encode manifest: %w", err))
+	}
+
+	cmd := exec.Command(tmpPath, args...)
+	cmd.Env = setEnv(os.Environ(), defaultEnvVarName, m.Executable)
+	cmd.Env = setEnv(cmd.Env, manifestEnvVar, manifestData)
+
+	return cmd
+}
+
+// failedCommand returns command which fails on start with provided error.
+// Path is left empty, so it never points to unpatched executable.
+func failedCommand(path string, args []string, err error) *exec.Cmd {
+	return &exec.Cmd{
+		Args: append([]string{path}, args...),
+		Err:  err,
+	}
+}
+
+func (p *Patcher) patchToTemp(path string, slots map[string]int) (string, map[string]int64, error) {
+	if p.stickyErr != nil {
+		return "", nil, p.stickyErr
+	}
+
+	tmp, err := copyToTemp(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("copy to temp file: %w", err)
+	}
+
+	defer tmp.Close()
+
+	gates, err := p.makeReplacements(tmp, slots)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", nil, err
+	}
+
 	_ = tmp.Sync()
-	_ = tmp.Close()
 
-	envVarValue := settings.envVarValue
-	if envVarValue == "" {
-		envVarValue = "1"
+	return tmp.Name(), gates, nil
+}
+
+// checkApplied checks that all registered replacements were applied to current executable.
+func (p *Patcher) checkApplied() error {
+	if applied == nil {
+		return nil
 	}
 
-	return execWithEnv(tmpPath, append(os.Environ(), settings.envVarName+"="+envVarValue))
+	var notApplied []string
+	for _, replacement := range p.manifest().Replacements {
+		// same function may be replaced by other patcher, so registration site compared too
+		if !applied.applies(replacement) {
+			notApplied = append(notApplied, replacement.Original)
+		}
+	}
+
+	if len(notApplied) > 0 {
+		return fmt.Errorf("%w: %s (register all replacements in single Patcher, i.e. using Register)",
+			ErrReplacementsNotApplied, strings.Join(notApplied, ", "))
+	}
+
+	return nil
 }
 
 // MustPatchAndExec acts like PatchAndExec but panics on errors.
@@ -1,8 +1,18 @@
 package monkey
 
 import (
+	"debug/pe"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -42,3 +52,835 @@ func TestRegisterNotFunction(t *testing.T) {
 		t.Errorf("Unexpected error: %s", err)
 	}
 }
+
+func TestManifest(t *testing.T) {
+	m := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			RegisterReplacement(patcher, time.Now, time.Now().UTC)
+			RegisterReplacement(patcher, runtime.GOMAXPROCS, func(int) int {
+				return -10
+			})
+		}).
+		manifest()
+
+	if len(m.Replacements) != 2 {
+		t.Fatalf("Unexpected replacements count: %d", len(m.Replacements))
+	}
+
+	if m.Replacements[0].Original != "runtime.GOMAXPROCS" || m.Replacements[1].Original != "time.Now" {
+		t.Errorf("Unexpected replacements order: %v", m.Replacements)
+	}
+
+	environ := setEnv([]string{"A=1", manifestEnvVar + "=old", "B=2"}, manifestEnvVar, "new")
+	if len(environ) != 3 || environ[2] != manifestEnvVar+"=new" {
+		t.Errorf("Unexpected environment: %v", environ)
+	}
+}
+
+func TestExecutableMarker(t *testing.T) {
+	if executableMarker("/tmp/a") == executableMarker("/tmp/b") {
+		t.Error("Marker not bound to executable path")
+	}
+
+	if executableMarker("/tmp/a") != executableMarker("/tmp/a") {
+		t.Error("Marker is not stable")
+	}
+}
+
+func TestReturnResultsMismatch(t *testing.T) {
+	for name, results := range map[string][]any{
+		"count":      {"host"},
+		"type":       {42, nil},
+		"nil":        {nil, nil},
+		"assignable": {"host", "error"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := NewPatcher().
+				Apply(func(patcher *Patcher) {
+					Return(patcher, os.Hostname, results)
+				}).
+				PatchAndExec()
+
+			if !errors.Is(err, ErrResultsMismatch) {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestReturnOptionResult(t *testing.T) {
+	if !hookSupported() {
+		t.Skip("Return not supported")
+	}
+
+	// results implementing RegisterOption are not treated as options
+	patcher := NewPatcher()
+	Return(patcher, WithOverride, []any{WithPriority(1)})
+
+	if err := patcher.stickyErr; err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+
+	stub := patcher.dispatched["github.com/xakep666/monkey.WithOverride"].value.Interface().(func() RegisterOption)
+
+	var options registerOptions
+	stub().applyRegister(&options)
+
+	if options.priority != 1 {
+		t.Errorf("Unexpected result: %+v", options)
+	}
+}
+
+func TestIsClosure(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"time.Now":                     false,
+		"main.init.0.func1":            true,
+		"main.init.0.func1.func2":      true,
+		"main.glob..func1":             true,
+		"main.X.Int-fm":                true,
+		"main.functional":              false,
+		"main.X.func":                  false,
+		"main.(*X).funcName":           false,
+		"github.com/a/b.Test.func12":   true,
+		"main.gen[...]":                false,
+		"main.gen[...].func1":          true,
+		"main.gen[...].func1[...]":     true,
+		"main.gen.func1[go.shape.int]": true,
+		"main.gen.func1[map[int]int]":  true,
+		"main.X[...].M-fm":             true,
+		"main.X[...].Func":             false,
+	} {
+		if isClosure(name) != expected {
+			t.Errorf("Unexpected result for %s", name)
+		}
+	}
+}
+
+// genericClosure returns function literal made inside generic function.
+func genericClosure[T any](v T) func() (T, error) {
+	return func() (T, error) { return v, nil }
+}
+
+func TestGenericClosure(t *testing.T) {
+	replacement := genericClosure("fake-host")
+
+	name := runtime.FuncForPC(reflect.ValueOf(replacement).Pointer()).Name()
+	if !isClosure(name) {
+		t.Fatalf("Closure %s inside generic function not detected", name)
+	}
+
+	if !dispatchSupported() {
+		t.Skip("dispatch table not supported")
+	}
+
+	patcher := NewPatcher()
+	RegisterReplacement(patcher, os.Hostname, replacement)
+
+	if _, ok := patcher.dispatched["os.Hostname"]; !ok {
+		t.Errorf("Closure %s not dispatched", name)
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	patcher := NewPatcher()
+
+	var wg sync.WaitGroup
+	for _, fn := range []func() time.Time{time.Now, time.Now().UTC, time.Now().Local} {
+		wg.Add(1)
+		go func(fn func() time.Time) {
+			defer wg.Done()
+			RegisterReplacement(patcher, fn, time.Now)
+		}(fn)
+	}
+
+	Return(patcher, runtime.NumCPU, []any{1})
+	wg.Wait()
+
+	if m := patcher.manifest(); len(m.Replacements) != 4 {
+		t.Errorf("Unexpected replacements: %v", m.Replacements)
+	}
+}
+
+func TestPatchFileFailure(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	for _, path := range []string{src, dst} {
+		if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+			t.Fatalf("Write %s: %s", path, err)
+		}
+	}
+
+	patcher := NewPatcher()
+
+	if err := patcher.PatchFile(src, src); err == nil {
+		t.Errorf("Patching of file to itself not failed")
+	}
+
+	if err := patcher.PatchFile(src, dst); err == nil {
+		t.Errorf("Patching of not executable not failed")
+	}
+
+	for _, path := range []string{src, dst} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Read %s: %s", path, err)
+		}
+
+		if string(content) != path {
+			t.Errorf("File %s modified: %q", path, content)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Read dir: %s", err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("Temporary files left: %v", entries)
+	}
+
+	cmd := patcher.Command(src)
+	if cmd.Err == nil {
+		t.Fatalf("Command for not executable not failed")
+	}
+
+	if cmd.Path != "" {
+		t.Errorf("Failed command has path %s", cmd.Path)
+	}
+}
+
+// buildFixture builds minimal program for provided GOOS and GOARCH and returns path to executable.
+func buildFixture(t *testing.T, goos, goarch string) string {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":  "module fixture\n\ngo 1.22\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("Write fixture source: %s", err)
+		}
+	}
+
+	cmd := exec.Command(goBin, "build", "-o", "fixture.exe", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=0")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Build fixture: %s\n%s", err, out)
+	}
+
+	return filepath.Join(dir, "fixture.exe")
+}
+
+func TestSignedBinary(t *testing.T) {
+	src := buildFixture(t, "windows", "amd64")
+	dst := filepath.Join(filepath.Dir(src), "patched.exe")
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Read fixture: %s", err)
+	}
+
+	// security data directory of PE32+ points to WIN_CERTIFICATE with junk instead of signature
+	data = append(data, make([]byte, (8-len(data)%8)%8)...)
+	security := data[binary.LittleEndian.Uint32(data[0x3c:])+4+20+112+pe.IMAGE_DIRECTORY_ENTRY_SECURITY*8:]
+	binary.LittleEndian.PutUint32(security, uint32(len(data)))
+	binary.LittleEndian.PutUint32(security[4:], 16)
+	data = append(data, 16, 0, 0, 0, 0, 2, 2, 0, 1, 2, 3, 4, 5, 6, 7, 8)
+
+	if err = os.WriteFile(src, data, 0o755); err != nil {
+		t.Fatalf("Write fixture: %s", err)
+	}
+
+	if err = NewPatcher().PatchFile(src, dst); !errors.Is(err, ErrSignedBinary) {
+		t.Errorf("Unexpected error for signed binary: %v", err)
+	}
+
+	if _, err = os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Signed binary patched: %v", err)
+	}
+
+	if err = NewPatcher(StripSignatures()).PatchFile(src, dst); err != nil {
+		t.Fatalf("Patch with stripped signature: %s", err)
+	}
+
+	patched, err := pe.Open(dst)
+	if err != nil {
+		t.Fatalf("Open patched: %s", err)
+	}
+
+	defer patched.Close()
+
+	if dir := patched.OptionalHeader.(*pe.OptionalHeader64).DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]; dir.Size != 0 {
+		t.Errorf("Signature not stripped: %+v", dir)
+	}
+}
+
+func TestCodeReplacementUnsupported(t *testing.T) {
+	for _, tc := range []struct {
+		goos, format string
+	}{{"windows", "PE"}, {"darwin", "Mach-O"}} {
+		t.Run(tc.format, func(t *testing.T) {
+			src := buildFixture(t, tc.goos, "amd64")
+
+			patcher := NewPatcher()
+			patcher.RegisterCodeReplacement("main.main", []byte{0xc3})
+
+			err := patcher.PatchFile(src, filepath.Join(filepath.Dir(src), "patched.exe"))
+			if !errors.Is(err, ErrCodeInjectionUnsupported) || !strings.Contains(err.Error(), tc.format) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPatchWASMDispatched(t *testing.T) {
+	patcher := NewPatcher()
+	patcher.dispatched = map[string]dispatchedReplacement{
+		"main.answer":      {name: "main.main.func1"}, // closure present in module
+		"main.otherAnswer": {},                        // synthesized replacement
+	}
+
+	err := patcher.patchWASM(nil)
+	if !errors.Is(err, ErrCurrentExecutableOnly) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "main.answer, main.otherAnswer") {
+		t.Errorf("Not all dispatched replacements reported: %s", err)
+	}
+}
+
+func TestNotAppliedReplacements(t *testing.T) {
+	t.Setenv("XXX_TEST_REPLACED", "1")
+
+	defer func(m *manifest) { applied = m }(applied)
+	applied = &manifest{Replacements: []Replacement{{Original: "time.Now"}}}
+
+	err := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			RegisterReplacement(patcher, time.Now, time.Now().UTC)
+			Return(patcher, runtime.NumCPU, []any{1})
+		}).
+		PatchAndExec(WithEnvVarName("XXX_TEST_REPLACED"), WithEnvVarValue("1"))
+
+	if !errors.Is(err, ErrReplacementsNotApplied) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestReplacementsOfOtherPatcher(t *testing.T) {
+	t.Setenv("XXX_TEST_REPLACED", "1")
+
+	register := func(patcher *Patcher) {
+		Return(patcher, runtime.NumCPU, []any{1})
+	}
+
+	other := NewPatcher().Apply(register)
+	patcher := NewPatcher().Apply(register)
+	patcher.Apply(func(patcher *Patcher) {
+		Return(patcher, runtime.NumCPU, []any{2}, WithOverride())
+	})
+
+	defer func(m *manifest) { applied = m }(applied)
+	applied = other.manifest()
+	applied.Slots = map[string]int{"runtime.NumCPU": 0}
+
+	defer func(v any) { dispatchTable[0] = v }(dispatchTable[0])
+	dispatchTable[0] = nil
+
+	err := patcher.PatchAndExec(WithEnvVarName("XXX_TEST_REPLACED"), WithEnvVarValue("1"))
+	if !errors.Is(err, ErrReplacementsNotApplied) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if dispatchTable[0] != nil {
+		t.Errorf("Replacement of other patcher placed to dispatch table")
+	}
+
+	// replacement registered at same place is the applied one
+	NewPatcher().Apply(register)
+
+	if dispatchTable[0] == nil {
+		t.Errorf("Applied replacement not placed to dispatch table")
+	}
+}
+
+func TestDuplicateReplacement(t *testing.T) {
+	fakeNow := func() time.Time { return time.Time{} }
+
+	err := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			RegisterReplacement(patcher, time.Now, fakeNow)
+			RegisterReplacement(patcher, time.Now, fakeNow)
+		}).
+		PatchAndExec()
+
+	if !errors.Is(err, ErrDuplicateReplacement) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if !strings.Contains(err.Error(), "monkey_internal_test.go") {
+		t.Errorf("Registration sites not reported: %s", err)
+	}
+}
+
+func TestReplacementPriority(t *testing.T) {
+	patcher := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			RegisterReplacement(patcher, time.Now, time.Now().UTC, WithPriority(-1))
+			RegisterReplacement(patcher, time.Now, time.Now().Local)
+			RegisterReplacement(patcher, time.Now, time.Now().UTC, WithPriority(-1))
+			Return(patcher, runtime.NumCPU, []any{1})
+			Return(patcher, runtime.NumCPU, []any{2}, WithOverride())
+		})
+
+	if patcher.stickyErr != nil {
+		t.Fatalf("Unexpected error: %s", patcher.stickyErr)
+	}
+
+	m := patcher.manifest()
+
+	for i, replacement := range m.Replacements {
+		if !strings.Contains(replacement.Site, "monkey_internal_test.go") {
+			t.Errorf("Unexpected registration site of %s: %s", replacement.Original, replacement.Site)
+		}
+
+		m.Replacements[i].Site = ""
+	}
+
+	expected := []Replacement{
+		{Original: "runtime.NumCPU", Replacement: "monkey.Return(runtime.NumCPU)"},
+		{Original: "time.Now", Replacement: "time.Time.Local-fm"},
+	}
+
+	if !reflect.DeepEqual(m.Replacements, expected) {
+		t.Errorf("Unexpected replacements: %v", m.Replacements)
+	}
+}
+
+func TestInjectResultsMismatch(t *testing.T) {
+	err := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			Inject(patcher, runtime.NumCPU, FailEveryN(1))
+		}).
+		PatchAndExec()
+
+	if !errors.Is(err, ErrResultsMismatch) && !errors.Is(err, ErrUnsupportedArchitecture) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestInjectReplacement(t *testing.T) {
+	if !hookSupported() {
+		t.Skip("Inject is not supported on this architecture")
+	}
+
+	errCustom := errors.New("custom")
+
+	patcher := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			Inject(patcher, strconv.Atoi, FailWith(FailOnArgs(func(args []any) bool {
+				return args[0] == "13"
+			}), errCustom))
+		})
+
+	if patcher.stickyErr != nil {
+		t.Fatalf("Unexpected error: %s", patcher.stickyErr)
+	}
+
+	// not patched executable, so replacement calls function itself
+	atoi := patcher.dispatched["strconv.Atoi"].value.Interface().(func(string) (int, error))
+
+	if n, err := atoi("42"); n != 42 || err != nil {
+		t.Errorf("Original function not called, returned: %d, %v", n, err)
+	}
+
+	if n, err := atoi("13"); n != 0 || !errors.Is(err, errCustom) {
+		t.Errorf("Fault not injected, returned: %d, %v", n, err)
+	}
+}
+
+func TestWrapReplacement(t *testing.T) {
+	if !CanCallOriginal() {
+		t.Skip("Wrap is not supported on this architecture")
+	}
+
+	patcher := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			Wrap(patcher, strconv.Itoa, func(itoa func(int) string) func(int) string {
+				return func(i int) string {
+					if i == 13 {
+						return "twelve plus one"
+					}
+
+					return itoa(i)
+				}
+			})
+		})
+
+	if patcher.stickyErr != nil {
+		t.Fatalf("Unexpected error: %s", patcher.stickyErr)
+	}
+
+	// not patched executable, so replacement calls function itself
+	itoa := patcher.dispatched["strconv.Itoa"].value.Interface().(func(int) string)
+
+	if s := itoa(42); s != "42" {
+		t.Errorf("Original function not called, returned: %s", s)
+	}
+
+	if s := itoa(13); s != "twelve plus one" {
+		t.Errorf("Replacement not called, returned: %s", s)
+	}
+
+	if name := patcher.manifest().Replacements[0].Replacement; name != "monkey.Wrap(strconv.Itoa)" {
+		t.Errorf("Unexpected replacement name: %s", name)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy   Policy
+		args     [][]any
+		expected []bool
+	}{
+		"every n": {
+			policy:   FailEveryN(3),
+			args:     make([][]any, 7),
+			expected: []bool{false, false, true, false, false, true, false},
+		},
+		"after": {
+			policy:   FailAfter(2),
+			args:     make([][]any, 4),
+			expected: []bool{false, false, true, true},
+		},
+		"never": {
+			policy:   FailWithProbability(1, 0),
+			args:     make([][]any, 3),
+			expected: []bool{false, false, false},
+		},
+		"always": {
+			policy:   FailWithProbability(1, 100),
+			args:     make([][]any, 3),
+			expected: []bool{true, true, true},
+		},
+		"args": {
+			policy: FailOnArgs(func(args []any) bool {
+				return args[0].(string) == "fail"
+			}),
+			args:     [][]any{{"ok"}, {"fail"}, {"ok"}},
+			expected: []bool{false, true, false},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for i, args := range tc.args {
+				err := tc.policy.Fail(args)
+				if (err != nil) != tc.expected[i] || err != nil && !errors.Is(err, ErrInjectedFault) {
+					t.Errorf("Unexpected result of call %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFailWithProbabilityReproducible(t *testing.T) {
+	first, second := FailWithProbability(42, 50), FailWithProbability(42, 50)
+
+	var failed int
+	for i := 0; i < 1000; i++ {
+		err := first.Fail(nil)
+		if (err != nil) != (second.Fail(nil) != nil) {
+			t.Fatalf("Different decisions for same seed on call %d", i)
+		}
+
+		if err != nil {
+			failed++
+		}
+	}
+
+	if failed < 400 || failed > 600 {
+		t.Errorf("Unexpected count of failed calls: %d", failed)
+	}
+}
+
+func TestSpyReplacement(t *testing.T) {
+	if !hookSupported() {
+		t.Skip("Spy is not supported on this architecture")
+	}
+
+	patcher := NewPatcher()
+	spy := Spy(patcher, strconv.Atoi)
+
+	if patcher.stickyErr != nil {
+		t.Fatalf("Unexpected error: %s", patcher.stickyErr)
+	}
+
+	// not patched executable, so replacement calls function itself
+	atoi := patcher.dispatched["strconv.Atoi"].value.Interface().(func(string) (int, error))
+
+	if n, err := atoi("42"); n != 42 || err != nil {
+		t.Errorf("Original function not called, returned: %d, %v", n, err)
+	}
+
+	if !spy.CalledWith("42") || spy.CalledWith("13") || spy.CalledWith(42) {
+		t.Errorf("Unexpected arguments: %v", spy.Calls())
+	}
+
+	calls := spy.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+
+	if calls[0].Results[0] != 42 || calls[0].Results[1] != nil {
+		t.Errorf("Unexpected results: %v", calls[0].Results)
+	}
+
+	calls[0].Unpack(func(s string) (int, error) {
+		if s != "42" {
+			t.Errorf("Unexpected unpacked argument: %s", s)
+		}
+
+		return 0, nil
+	})
+
+	if calls[0].Goroutine != goroutineID() || calls[0].Goroutine == 0 {
+		t.Errorf("Unexpected goroutine: %d", calls[0].Goroutine)
+	}
+
+	spy.Reset()
+
+	if spy.CallCount() != 0 {
+		t.Errorf("Calls not removed: %v", spy.Calls())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	type node struct {
+		name string
+		next *node
+		tags map[string][]int
+	}
+
+	cyclic := &node{name: "a", tags: map[string][]int{"x": {1, 2}}}
+	cyclic.next = cyclic
+
+	buf := []byte("buf")
+	values := snapshot([]reflect.Value{
+		reflect.ValueOf(cyclic),
+		reflect.ValueOf(buf),
+		reflect.ValueOf([]any{"s", 1}),
+		reflect.ValueOf(strconv.Itoa),
+	})
+
+	copied := values[0].(*node)
+	if copied == cyclic || copied.next != copied || copied.name != "a" || !reflect.DeepEqual(copied.tags, cyclic.tags) {
+		t.Errorf("Unexpected copy of pointer: %+v", copied)
+	}
+
+	buf[0] = 'x'
+	if string(values[1].([]byte)) != "buf" {
+		t.Errorf("Slice not copied: %s", values[1])
+	}
+
+	if !reflect.DeepEqual(values[2], []any{"s", 1}) {
+		t.Errorf("Unexpected copy of interfaces: %v", values[2])
+	}
+
+	if values[3].(func(int) string) != nil {
+		t.Error("Function copied")
+	}
+}
+
+type recordingT struct {
+	errors   []string
+	cleanups []func()
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) Cleanup(f func()) { t.cleanups = append(t.cleanups, f) }
+
+func TestExpectReplacement(t *testing.T) {
+	if !dispatchSupported() {
+		t.Skip("Mock is not supported on this architecture")
+	}
+
+	patcher := NewPatcher()
+	rt := &recordingT{}
+
+	Expect(rt, patcher, strconv.Atoi).With("42").Return(100500, nil).Times(2)
+	Expect(rt, patcher, strconv.Atoi).With("x").Do(func(string) (int, error) { return -1, nil })
+	Expect(rt, patcher, strconv.Atoi).With("never")
+
+	if patcher.stickyErr != nil {
+		t.Fatalf("Unexpected error: %s", patcher.stickyErr)
+	}
+
+	if len(rt.cleanups) != 1 {
+		t.Fatalf("Unexpected count of cleanups: %d", len(rt.cleanups))
+	}
+
+	atoi := patcher.dispatched["strconv.Atoi"].value.Interface().(func(string) (int, error))
+
+	for i, tc := range []struct {
+		arg      string
+		expected int
+	}{{"42", 100500}, {"x", -1}, {"42", 100500}, {"42", 0}} {
+		if n, err := atoi(tc.arg); n != tc.expected || err != nil {
+			t.Errorf("Unexpected result of call %d: %d, %v", i, n, err)
+		}
+	}
+
+	for _, cleanup := range rt.cleanups {
+		cleanup()
+	}
+
+	if len(rt.errors) != 3 {
+		t.Fatalf("Unexpected verification errors: %q", rt.errors)
+	}
+
+	if !strings.Contains(rt.errors[0], "unexpected call of strconv.Atoi[42]") ||
+		!strings.Contains(rt.errors[0], "testing.tRunner") {
+		t.Errorf("Unexpected call not reported with stack: %s", rt.errors[0])
+	}
+
+	if !strings.Contains(rt.errors[1], "expected 1 calls of strconv.Atoi[never], got 0") {
+		t.Errorf("Unmet expectation not reported: %s", rt.errors[1])
+	}
+
+	if !strings.Contains(rt.errors[2], ErrReplacementsNotApplied.Error()) {
+		t.Errorf("Not applied mock not reported: %s", rt.errors[2])
+	}
+
+	if n, _ := atoi("42"); n != 0 {
+		t.Errorf("Expectations not removed after verification, returned: %d", n)
+	}
+}
+
+// joinErrors joins verification errors to check them regardless of order.
+func (t *recordingT) joinErrors() string { return strings.Join(t.errors, "\n") }
+
+func TestExpectOwners(t *testing.T) {
+	if !dispatchSupported() {
+		t.Skip("Mock is not supported on this architecture")
+	}
+
+	patcher := NewPatcher()
+	first, second := &recordingT{}, &recordingT{}
+
+	Expect(first, patcher, strconv.Atoi).With("1").Return(1, nil)
+	Expect(second, patcher, strconv.Itoa).With(2).Return("two")
+
+	atoi := patcher.dispatched["strconv.Atoi"].value.Interface().(func(string) (int, error))
+	itoa := patcher.dispatched["strconv.Itoa"].value.Interface().(func(int) string)
+
+	_, _ = atoi("1")
+	_, _ = atoi("x") // only first has expectations on Atoi
+
+	Expect(second, patcher, strconv.Atoi).With("2").AnyTimes()
+
+	_, _ = atoi("y") // both have expectations on Atoi
+
+	for _, cleanup := range second.cleanups {
+		cleanup()
+	}
+
+	if errs := second.joinErrors(); strings.Contains(errs, "strconv.Atoi[x]") ||
+		!strings.Contains(errs, "unexpected call of strconv.Atoi[y]") ||
+		!strings.Contains(errs, "expected 1 calls of strconv.Itoa[2], got 0") {
+		t.Errorf("Unexpected verification errors of second test: %q", second.errors)
+	}
+
+	// there are no expectations on Itoa, so call reported to any test
+	if s := itoa(2); s != "" {
+		t.Errorf("Expectation of second test not removed, returned: %s", s)
+	}
+
+	for _, cleanup := range first.cleanups {
+		cleanup()
+	}
+
+	if errs := first.joinErrors(); !strings.Contains(errs, "unexpected call of strconv.Atoi[x]") ||
+		!strings.Contains(errs, "unexpected call of strconv.Atoi[y]") ||
+		!strings.Contains(errs, "unexpected call of strconv.Itoa[2]") || strings.Contains(errs, "expected 1 calls") {
+		t.Errorf("Unexpected verification errors of first test: %q", first.errors)
+	}
+
+	for _, m := range patcher.mocks {
+		if len(m.expected) != 0 || len(m.unexpected) != 0 {
+			t.Errorf("Expectations of %s not removed: %d expected, %d unexpected", m.name, len(m.expected), len(m.unexpected))
+		}
+	}
+}
+
+func TestExpectResultsMismatch(t *testing.T) {
+	if !dispatchSupported() {
+		t.Skip("Mock is not supported on this architecture")
+	}
+
+	rt := &recordingT{}
+
+	err := NewPatcher().
+		Apply(func(patcher *Patcher) {
+			Expect(rt, patcher, os.Hostname).Return(42, nil)
+		}).
+		PatchAndExec()
+
+	if !errors.Is(err, ErrResultsMismatch) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestExpectArgumentsMismatch(t *testing.T) {
+	if !dispatchSupported() {
+		t.Skip("Mock is not supported on this architecture")
+	}
+
+	rt := &recordingT{}
+	patcher := NewPatcher()
+
+	Expect(rt, patcher, strconv.Atoi).With(42)
+
+	if !errors.Is(patcher.stickyErr, ErrArgumentsMismatch) {
+		t.Errorf("Unexpected error: %v", patcher.stickyErr)
+	}
+
+	for _, cleanup := range rt.cleanups {
+		cleanup()
+	}
+
+	if len(rt.errors) == 0 || !strings.Contains(rt.errors[0], ErrArgumentsMismatch.Error()) {
+		t.Errorf("Invalid arguments not reported: %q", rt.errors)
+	}
+}
+
+func TestExpectNotFunction(t *testing.T) {
+	rt := &recordingT{}
+	patcher := NewPatcher()
+
+	// must not panic
+	Expect(rt, patcher, 42).With(1).Return(2).Times(1)
+
+	if !errors.Is(patcher.stickyErr, ErrFunctionNotFound) {
+		t.Errorf("Unexpected error: %v", patcher.stickyErr)
+	}
+
+	if len(rt.cleanups) != 0 {
+		t.Errorf("Verification registered for not a function")
+	}
+}
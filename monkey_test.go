@@ -3,7 +3,15 @@
 package monkey_test
 
 import (
+	"errors"
+	"fmt"
 	"github.com/xakep666/monkey"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,13 +21,37 @@ type X struct{}
 //go:noinline
 func (X) Int() int { return 42 }
 
+//go:noinline
+func Hostname() (string, error) { return os.Hostname() }
+
 type Y interface {
 	Z() string
 }
 
+//go:noinline
+func Counter() int { return 0 }
+
+// replacement called before registration in patched executable
+var startTime = time.Now()
+
+// synthesized replacement is not registered yet, so original function called
+var startHostname, _ = Hostname()
+
+// testPatcher is applied to test executable, tests set expectations on it.
+var testPatcher *monkey.Patcher
+
 func init() {
+	// helper processes are patched by parent
+	if os.Getenv("MONKEY_HELPER_PROCESS") != "" {
+		return
+	}
+
+	var counter int
+
 	monkey.NewPatcher().
 		Apply(func(patcher *monkey.Patcher) {
+			testPatcher = patcher
+
 			// works if not inlined
 			monkey.RegisterReplacement(patcher, time.Now, func() time.Time {
 				return time.Date(1980, 1, 2, 3, 4, 5, 6, time.UTC)
@@ -31,14 +63,92 @@ func init() {
 			monkey.RegisterReplacement(patcher, Y.Z, func(Y) string {
 				return "xxx"
 			})
-		}).MustPatchAndExec()
+			if runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" {
+				monkey.Return(patcher, Hostname, []any{"ci-host", nil})
+			}
+			// expectations made in test
+			monkey.Mock(patcher, Lookup)
+			// captured variables available only on some architectures
+			monkey.RegisterReplacement(patcher, Counter, func() int {
+				counter++
+				return counter
+			})
+		}).
+		Apply(registerHooked).
+		MustPatchAndExec()
+}
+
+//go:noinline
+func Lookup(key string) (string, bool) { return "", false }
+
+//go:noinline
+func Checksum(data []byte) (uint32, error) {
+	var table [4096]uint32 // large frame has different prologue
+	for i := range table {
+		table[i] = uint32(i) * 2654435761
+	}
+
+	var sum uint32
+	for _, b := range data {
+		sum = sum*31 + table[b]
+	}
+
+	return sum, nil
+}
+
+//go:noinline
+func Depth(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	return Depth(n - 1)
+}
+
+var depthCalls atomic.Int64
+
+//go:noinline
+func Join(sep string, parts ...string) (string, error) { return strings.Join(parts, sep), nil }
+
+var joinSpy *monkey.Recorder[func(string, ...string) (string, error)]
+
+// registerHooked registers replacements calling original functions.
+func registerHooked(patcher *monkey.Patcher) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		return
+	}
+
+	monkey.Inject(patcher, os.WriteFile, monkey.FailOnArgs(func(args []any) bool {
+		return strings.HasSuffix(args[0].(string), "fail")
+	}))
+	monkey.Inject(patcher, Checksum, monkey.FailAfter(1))
+	// counts calls, so repeated call of replacement after stack growth is detected
+	monkey.Inject(patcher, Depth, monkey.PolicyFunc(func([]any) error {
+		depthCalls.Add(1)
+		return nil
+	}))
+	joinSpy = monkey.Spy(patcher, Join)
 }
 
 func TestMonkey_Integration(t *testing.T) {
+	if !monkey.IsPatched() {
+		t.Fatal("Not running patched executable")
+	}
+
+	t.Logf("Applied replacements: %v", monkey.AppliedReplacements())
+
+	if _, ok := os.LookupEnv("XXX_REPLACED"); ok {
+		t.Error("Marker environment variable was not removed")
+	}
+
 	if now := time.Now(); !now.Equal(time.Date(1980, 1, 2, 3, 4, 5, 6, time.UTC)) {
 		t.Errorf("Time not patched, returned: %s", now)
 	}
 
+	if !startTime.Equal(time.Date(1980, 1, 2, 3, 4, 5, 6, time.UTC)) {
+		t.Errorf("Time not patched before registration, returned: %s", startTime)
+	}
+
 	if ret := Y.Z(nil); ret != "xxx" {
 		t.Errorf("Nil interface call not patched, returned: %s", ret)
 	}
@@ -46,4 +156,233 @@ func TestMonkey_Integration(t *testing.T) {
 	if ret := (X{}).Int(); ret != 100500 {
 		t.Errorf("Method call not patched, returned: %d", ret)
 	}
+
+	if runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" {
+		if hostname, err := Hostname(); hostname != "ci-host" || err != nil {
+			t.Errorf("Return stub not applied, returned: %s, %v", hostname, err)
+		}
+
+		if hostname, _ := os.Hostname(); startHostname != hostname {
+			t.Errorf("Original function not called before registration, returned: %s", startHostname)
+		}
+	}
+
+	if runtime.GOARCH == "amd64" || runtime.GOARCH == "386" || runtime.GOARCH == "arm64" {
+		if first, second := Counter(), Counter(); first != 1 || second != 2 {
+			t.Errorf("Capturing closure not patched, returned: %d, %d", first, second)
+		}
+	}
+}
+
+func TestInject_Integration(t *testing.T) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skip("Calling original function supported only on amd64 and arm64")
+	}
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "ok"), []byte("data"), 0o600); err != nil {
+		t.Errorf("Original function not called, returned: %s", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "ok")); err != nil || string(data) != "data" {
+		t.Errorf("Original function didn't write file, read: %q, %v", data, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "fail"), []byte("data"), 0o600); !errors.Is(err, monkey.ErrInjectedFault) {
+		t.Errorf("Fault not injected, returned: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "fail")); !os.IsNotExist(err) {
+		t.Errorf("Original function called on fault, stat returned: %v", err)
+	}
+
+	// new goroutine has small stack, so it grows inside original function
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if sum, err := Checksum([]byte("abc")); sum == 0 || err != nil {
+			t.Errorf("Original function not called, returned: %d, %v", sum, err)
+		}
+
+		if sum, err := Checksum([]byte("abc")); sum != 0 || !errors.Is(err, monkey.ErrInjectedFault) {
+			t.Errorf("Fault not injected, returned: %d, %v", sum, err)
+		}
+
+		if err := Depth(1000); err != nil || depthCalls.Load() != 1001 {
+			t.Errorf("Unexpected recursive calls: %d, %v", depthCalls.Load(), err)
+		}
+	}()
+	<-done
+}
+
+func TestSpy_Integration(t *testing.T) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skip("Calling original function supported only on amd64 and arm64")
+	}
+
+	joinSpy.Reset()
+
+	if ret, err := Join("-", "a", "b"); ret != "a-b" || err != nil {
+		t.Errorf("Original function not called, returned: %s, %v", ret, err)
+	}
+
+	if !joinSpy.CalledWith("-", []string{"a", "b"}) {
+		t.Errorf("Call not recorded: %v", joinSpy.Calls())
+	}
+
+	calls := joinSpy.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+
+	if calls[0].Results[0] != "a-b" || calls[0].Results[1] != nil {
+		t.Errorf("Unexpected results: %v", calls[0].Results)
+	}
+
+	calls[0].Unpack(func(sep string, parts ...string) (string, error) {
+		if sep != "-" || len(parts) != 2 || parts[0] != "a" || parts[1] != "b" {
+			t.Errorf("Unexpected unpacked arguments: %s, %v", sep, parts)
+		}
+
+		return "", nil
+	})
+
+	if calls[0].Caller.Function != "github.com/xakep666/monkey_test.TestSpy_Integration" {
+		t.Errorf("Unexpected caller: %s", calls[0].Caller.Function)
+	}
+
+	if !calls[0].Time.Equal(time.Date(1980, 1, 2, 3, 4, 5, 6, time.UTC)) {
+		t.Errorf("Time of call not obtained from replaced clock: %s", calls[0].Time)
+	}
+}
+
+//go:noinline
+func helperValue() string { return "original" }
+
+func helperReplacement() string { return "patched" }
+
+// registerHelperValue is shared by parent and helper process: registration sites must match.
+func registerHelperValue(patcher *monkey.Patcher) {
+	monkey.RegisterReplacement(patcher, helperValue, helperReplacement)
+}
+
+//go:noinline
+func helperAnswer() int { return 1 }
+
+func TestHelperProcess_Integration(t *testing.T) {
+	switch os.Getenv("MONKEY_HELPER_PROCESS") {
+	case "value":
+		fmt.Print(helperValue())
+	case "answer":
+		fmt.Print(helperAnswer())
+	case "patch":
+		// process started by Command is already patched, so it's not patched and started again
+		err := monkey.NewPatcher().Apply(registerHelperValue).PatchAndExec()
+		myPath, _ := os.Executable()
+		fmt.Print(helperValue(), " ", filepath.Base(myPath), " ", err)
+	default:
+		t.Skip("Not a helper process")
+	}
+
+	os.Exit(0)
+}
+
+func TestPatcherCommand_Integration(t *testing.T) {
+	myPath, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Get executable: %s", err)
+	}
+
+	cmd := monkey.NewPatcher().
+		Apply(func(patcher *monkey.Patcher) {
+			monkey.RegisterReplacement(patcher, helperValue, helperReplacement)
+		}).
+		Command(myPath, "-test.run=^TestHelperProcess_Integration$")
+	cmd.Env = append(cmd.Env, "MONKEY_HELPER_PROCESS=value")
+
+	if cmd.Err == nil {
+		defer os.Remove(cmd.Path)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Run helper process: %s", err)
+	}
+
+	if string(out) != "patched" {
+		t.Errorf("Helper process not patched, returned: %s", out)
+	}
+}
+
+func TestPatcherCommandPatchAndExec_Integration(t *testing.T) {
+	myPath, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Get executable: %s", err)
+	}
+
+	cmd := monkey.NewPatcher().Apply(registerHelperValue).Command(myPath, "-test.run=^TestHelperProcess_Integration$")
+	cmd.Env = append(cmd.Env, "MONKEY_HELPER_PROCESS=patch")
+
+	if cmd.Err == nil {
+		defer os.Remove(cmd.Path)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Run helper process: %s", err)
+	}
+
+	if expected := "patched " + filepath.Base(cmd.Path) + " <nil>"; string(out) != expected {
+		t.Errorf("Unexpected helper process output: %s, expected %s", out, expected)
+	}
+}
+
+func TestCodeReplacement_Integration(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("Code injection test implemented only for linux/amd64")
+	}
+
+	myPath, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Get executable: %s", err)
+	}
+
+	patcher := monkey.NewPatcher()
+	patcher.RegisterCodeReplacement(runtime.FuncForPC(reflect.ValueOf(helperAnswer).Pointer()).Name(), []byte{
+		0x48, 0xc7, 0xc0, 0x2a, 0x00, 0x00, 0x00, // mov rax, 42
+		0xc3, // ret
+	})
+
+	cmd := patcher.Command(myPath, "-test.run=^TestHelperProcess_Integration$")
+	cmd.Env = append(cmd.Env, "MONKEY_HELPER_PROCESS=answer")
+
+	if cmd.Err == nil {
+		defer os.Remove(cmd.Path)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Run helper process: %s", err)
+	}
+
+	if string(out) != "42" {
+		t.Errorf("Helper process not patched, returned: %s", out)
+	}
+}
+
+func TestExpect_Integration(t *testing.T) {
+	monkey.Expect(t, testPatcher, Lookup).With("a").Return("1", true).Times(2)
+	monkey.Expect(t, testPatcher, Lookup).With("b").Do(func(key string) (string, bool) {
+		return key + key, true
+	})
+
+	for _, tc := range []struct {
+		key, expected string
+	}{{"a", "1"}, {"b", "bb"}, {"a", "1"}} {
+		if value, ok := Lookup(tc.key); value != tc.expected || !ok {
+			t.Errorf("Unexpected result for %s: %s, %t", tc.key, value, ok)
+		}
+	}
 }
@@ -0,0 +1,17 @@
+// Package monkeyplugin opens go plugins (-buildmode=plugin) patched by monkey.Patcher, so extension points
+// implemented by plugins may be faked in tests.
+// It's a shorthand for monkey.OpenPlugin with plugin.Open placed to separate package because import of package plugin
+// makes linker keep and export all symbols of executable, so it shouldn't affect users of monkey not loading plugins.
+package monkeyplugin
+
+import (
+	"plugin"
+
+	"github.com/xakep666/monkey"
+)
+
+// Open makes patched copy of plugin located at path and loads it using plugin.Open.
+// See monkey.OpenPlugin for details.
+func Open(p *monkey.Patcher, path string) (*plugin.Plugin, error) {
+	return monkey.OpenPlugin(p, path, plugin.Open)
+}
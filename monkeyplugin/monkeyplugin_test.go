@@ -0,0 +1,86 @@
+//go:build integration
+
+package monkeyplugin_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/xakep666/monkey"
+	"github.com/xakep666/monkey/monkeyplugin"
+)
+
+// pluginSource is a plugin exporting extension point with fake implementation linked into it.
+const pluginSource = `package main
+
+//go:noinline
+func Answer() int { return 1 }
+
+//go:noinline
+func FakeAnswer() int { return 2 }
+`
+
+// raceFlags are passed to go build if test binary built with race detector.
+var raceFlags []string
+
+func buildPlugin(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("cc"); err != nil || runtime.GOOS != "linux" {
+		t.Skip("plugins not supported")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module fixture\n"), 0o644); err != nil {
+		t.Fatalf("Write go.mod: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(pluginSource), 0o644); err != nil {
+		t.Fatalf("Write plugin: %s", err)
+	}
+
+	// runtime of plugin must match runtime of test binary
+	args := append([]string{"build", "-buildmode=plugin", "-ldflags=-pluginpath=fixture", "-o", "fixture.so"}, raceFlags...)
+
+	cmd := exec.Command("go", append(args, ".")...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=1", "GOFLAGS=")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Build plugin: %s\n%s", err, out)
+	}
+
+	return filepath.Join(dir, "fixture.so")
+}
+
+func TestOpen_Integration(t *testing.T) {
+	path := buildPlugin(t)
+
+	p := monkey.NewPatcher()
+	p.RegisterNamedReplacementByName("fixture.Answer", "fixture.MissingAnswer")
+
+	if _, err := monkeyplugin.Open(p, path); !errors.Is(err, monkey.ErrFunctionNotFound) {
+		t.Fatalf("Unexpected error for missing replacement: %v", err)
+	}
+
+	p = monkey.NewPatcher()
+	p.RegisterNamedReplacementByName("fixture.Answer", "fixture.FakeAnswer")
+
+	plug, err := monkeyplugin.Open(p, path)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	answer, err := plug.Lookup("Answer")
+	if err != nil {
+		t.Fatalf("Lookup: %s", err)
+	}
+
+	if got := answer.(func() int)(); got != 2 {
+		t.Errorf("Unexpected answer: %d", got)
+	}
+}
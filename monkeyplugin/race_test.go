@@ -0,0 +1,7 @@
+//go:build integration && race
+
+package monkeyplugin_test
+
+func init() {
+	raceFlags = []string{"-race"}
+}
@@ -1,8 +1,12 @@
 package monkey
 
+// defaultEnvVarName is a name of environment variable marking patched executable unless WithEnvVarName used.
+const defaultEnvVarName = "XXX_REPLACED"
+
 type patchAndExecOptions struct {
 	envVarName, envVarValue string
 	removePatched           bool
+	keepEnvVar              bool
 }
 
 type PatchAndExecOption interface {
@@ -27,7 +31,8 @@ func WithEnvVarName(name string) PatchAndExecOption {
 }
 
 // WithEnvVarValue sets exact value for environment variable used to determine if code runs inside patched executable or not.
-// Without this option only presence of variable will be checked.
+// Without this option value bound to patched executable is used, so other executables started with inherited
+// environment will not treat themselves as patched.
 func WithEnvVarValue(value string) PatchAndExecOption {
 	return optionFunc(func(options *patchAndExecOptions) {
 		options.envVarValue = value
@@ -40,3 +45,81 @@ func RemovePatchedExecutable() PatchAndExecOption {
 		options.removePatched = true
 	})
 }
+
+// KeepEnvVar disables removal of environment variables used by patched executable.
+// Note that such variables will be inherited by subprocesses.
+func KeepEnvVar() PatchAndExecOption {
+	return optionFunc(func(options *patchAndExecOptions) {
+		options.keepEnvVar = true
+	})
+}
+
+type registerOptions struct {
+	priority int
+	override bool
+}
+
+// RegisterOption configures replacement registration.
+type RegisterOption interface {
+	applyRegister(*registerOptions)
+}
+
+func newRegisterOptions(opts ...RegisterOption) registerOptions {
+	var o registerOptions
+	for _, option := range opts {
+		option.applyRegister(&o)
+	}
+
+	return o
+}
+
+type registerOptionFunc func(*registerOptions)
+
+func (o registerOptionFunc) applyRegister(options *registerOptions) { o(options) }
+
+// WithPriority sets priority of replacement, default is 0. If same function registered several times, replacement
+// with higher priority wins. Registration of same function with same priority results in ErrDuplicateReplacement.
+// I.e. shared helpers may register default replacements with negative priority so tests may override them.
+func WithPriority(priority int) RegisterOption {
+	return registerOptionFunc(func(options *registerOptions) {
+		options.priority = priority
+	})
+}
+
+// WithOverride makes replacement win over previously registered replacements of same function regardless of priority.
+func WithOverride() RegisterOption {
+	return registerOptionFunc(func(options *registerOptions) {
+		options.override = true
+	})
+}
+
+type patcherOptions struct {
+	stripSignatures bool
+}
+
+// PatcherOption configures Patcher, see NewPatcher.
+type PatcherOption interface {
+	applyPatcher(*patcherOptions)
+}
+
+func newPatcherOptions(opts ...PatcherOption) patcherOptions {
+	var o patcherOptions
+	for _, option := range opts {
+		option.applyPatcher(&o)
+	}
+
+	return o
+}
+
+type patcherOptionFunc func(*patcherOptions)
+
+func (o patcherOptionFunc) applyPatcher(options *patcherOptions) { o(options) }
+
+// StripSignatures makes patcher remove signatures (i.e. Authenticode of PE files) invalidated by patching
+// instead of failing with ErrSignedBinary. Note that policies requiring signed executables will refuse
+// to run patched ones.
+func StripSignatures() PatcherOption {
+	return patcherOptionFunc(func(options *patcherOptions) {
+		options.stripSignatures = true
+	})
+}
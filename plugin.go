@@ -0,0 +1,37 @@
+package monkey
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// OpenPlugin makes patched copy of go plugin (-buildmode=plugin) located at path like PatchFile does
+// and loads it by open, which is plugin.Open usually:
+//
+//	plug, err := monkey.OpenPlugin(patcher, "ext.so", plugin.Open)
+//
+// Package plugin is not imported here because it makes linker keep and export all symbols of executable,
+// so users not loading plugins aren't affected. Copy is placed to temporary directory and removed after loading.
+//
+// Replacements are looked up by names in plugin, so both original and replacement functions must be linked
+// into plugin (see RegisterNamedReplacementByName). Functions of main package of plugin are named using plugin path
+// (set by -pluginpath linker flag). Replacements made at runtime (closures, Expect, etc.) can't be applied to plugins.
+// Note that plugin with same plugin path may be loaded only once, so original plugin must not be loaded before.
+func OpenPlugin[P any](p *Patcher, path string, open func(path string) (P, error)) (P, error) {
+	var plug P
+
+	dir, err := os.MkdirTemp("", "monkeyplugin")
+	if err != nil {
+		return plug, fmt.Errorf("create temp dir: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	patched := filepath.Join(dir, filepath.Base(path))
+	if err = p.PatchFile(path, patched); err != nil {
+		return plug, err
+	}
+
+	return open(patched)
+}
@@ -0,0 +1,24 @@
+package monkey
+
+// defaultPatcher is a process-wide registry of replacements.
+var defaultPatcher = NewPatcher()
+
+// Default returns process-wide Patcher used by Register, PatchAndExec and MustPatchAndExec.
+// It's useful to register replacements using functions accepting Patcher, i.e. Return.
+func Default() *Patcher { return defaultPatcher }
+
+// Register registers function replacement in process-wide registry. See RegisterReplacement for details.
+// It may be called from init of any package, registered replacements applied at once by PatchAndExec.
+func Register[T any](original, replacement T, opts ...RegisterOption) {
+	registerReplacement(defaultPatcher, original, replacement, registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	})
+}
+
+// PatchAndExec applies replacements from process-wide registry. See Patcher.PatchAndExec for details.
+// It should be called once from TestMain or main when all packages registered their replacements.
+func PatchAndExec(opts ...PatchAndExecOption) error { return defaultPatcher.PatchAndExec(opts...) }
+
+// MustPatchAndExec acts like PatchAndExec but panics on errors.
+func MustPatchAndExec(opts ...PatchAndExecOption) { defaultPatcher.MustPatchAndExec(opts...) }
@@ -0,0 +1,91 @@
+package monkey
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Return registers replacement of original function by function that returns provided values.
+// Values must match original function results: be assignable to them or be nil for nilable types.
+// Replacement synthesized at runtime, so it's called via dispatch table. Original function called
+// until replacement registered in patched executable (i.e. from init functions).
+// Replacement is listed as "monkey.Return(<original>)" by AppliedReplacements.
+// This works only on some architectures (currently amd64 and arm64) and only for current executable.
+func Return[T any](p *Patcher, original T, results []any, opts ...RegisterOption) {
+	reg := registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}
+
+	originalValue := reflect.ValueOf(original)
+	if originalValue.Kind() != reflect.Func {
+		p.fail(ErrFunctionNotFound)
+		return
+	}
+
+	originalName, ok := funcName(originalValue)
+	if !ok {
+		p.fail(ErrFunctionNotFound)
+		return
+	}
+
+	resultValues, err := makeResults(originalValue.Type(), results)
+	if err != nil {
+		p.fail(fmt.Errorf("%s: %w", originalName, err))
+		return
+	}
+
+	if !hookSupported() {
+		p.fail(fmt.Errorf("%s: %w", originalName, ErrUnsupportedArchitecture))
+		return
+	}
+
+	p.registerDispatched(originalName, dispatchedReplacement{
+		value: reflect.MakeFunc(originalValue.Type(), func([]reflect.Value) []reflect.Value {
+			return resultValues
+		}),
+		label: "monkey.Return(" + originalName + ")",
+		hook:  true,
+	}, reg)
+}
+
+func makeResults(funcType reflect.Type, results []any) ([]reflect.Value, error) {
+	values, err := makeValues(funcType.Out, funcType.NumOut(), results)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrResultsMismatch, err)
+	}
+
+	return values, nil
+}
+
+// makeValues converts values to types returned by typeOf for indexes below count.
+func makeValues(typeOf func(int) reflect.Type, count int, args []any) ([]reflect.Value, error) {
+	if count != len(args) {
+		return nil, fmt.Errorf("expected %d values, got %d", count, len(args))
+	}
+
+	values := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		typ := typeOf(i)
+
+		if arg == nil {
+			switch typ.Kind() {
+			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
+				values[i] = reflect.Zero(typ)
+				continue
+			default:
+				return nil, fmt.Errorf("nil is not allowed for value %d of type %s", i, typ)
+			}
+		}
+
+		value := reflect.ValueOf(arg)
+		if !value.Type().AssignableTo(typ) {
+			return nil, fmt.Errorf("value %d of type %s is not assignable to %s", i, value.Type(), typ)
+		}
+
+		values[i] = reflect.New(typ).Elem()
+		values[i].Set(value)
+	}
+
+	return values, nil
+}
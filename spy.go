@@ -0,0 +1,302 @@
+package monkey
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Call describes call of function of type T recorded by Spy.
+type Call[T any] struct {
+	// Args contains copies of arguments of call (see snapshot). For methods receiver is the first argument,
+	// variadic arguments stored as slice.
+	Args []any
+
+	// Results contains copies of values returned by call. It's empty if call panicked.
+	Results []any
+
+	// Goroutine is an identifier of goroutine which made call.
+	Goroutine uint64
+
+	// Time is a moment of call obtained by time.Now, so it follows replaced clock (i.e. faketime).
+	Time time.Time
+
+	// Caller is a stack frame of code which made call.
+	Caller runtime.Frame
+}
+
+// Unpack calls fn with recorded arguments, so they may be obtained with their types:
+//
+//	call.Unpack(func(url string) (*http.Response, error) {
+//		// check url
+//		return nil, nil
+//	})
+func (c Call[T]) Unpack(fn T) {
+	fnValue := reflect.ValueOf(fn)
+
+	// recorded arguments are copies of arguments of function of same type, so they always match
+	args, _ := makeValues(fnValue.Type().In, fnValue.Type().NumIn(), c.Args)
+	if fnValue.Type().IsVariadic() {
+		fnValue.CallSlice(args)
+		return
+	}
+
+	fnValue.Call(args)
+}
+
+// Recorder contains calls of function of type T recorded by Spy. It's safe for concurrent use.
+type Recorder[T any] struct {
+	mu       sync.Mutex
+	funcType reflect.Type
+	calls    []Call[T]
+}
+
+// Spy registers replacement of original function which records calls and calls original function.
+// Replacement synthesized at runtime and calls original function, so this works only on some
+// architectures (currently amd64 and arm64), only for current executable and only for functions beginning with
+// usual prologue (ErrUnsupportedPrologue returned otherwise). Functions called by Spy itself (i.e. time.Now)
+// can't be spied.
+//
+//	spy := monkey.Spy(patcher, http.Get)
+//	...
+//	if !spy.CalledWith("https://example.com") { ... }
+//
+// Note that argument must be function despite "any" used as constraint. See RegisterReplacement for details.
+func Spy[T any](p *Patcher, original T, opts ...RegisterOption) *Recorder[T] {
+	reg := registration{
+		registerOptions: newRegisterOptions(opts...),
+		site:            callerSite(1),
+	}
+
+	r := &Recorder[T]{}
+
+	h, err := newHookedFunc(original)
+	if err != nil {
+		p.fail(err)
+		return r
+	}
+
+	r.funcType = h.funcType
+
+	p.registerHooked(h, func(args []reflect.Value) (results []reflect.Value) {
+		call := Call[T]{
+			Args:      snapshot(args),
+			Goroutine: goroutineID(),
+			Time:      time.Now(),
+			Caller:    callerFrame(),
+		}
+
+		// call recorded even if original function panics
+		defer func() {
+			if results != nil {
+				call.Results = snapshot(results)
+			}
+
+			r.record(call)
+		}()
+
+		return h.call(args)
+	}, reg)
+
+	return r
+}
+
+// Calls returns recorded calls in order of their completion.
+func (r *Recorder[T]) Calls() []Call[T] {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Call[T](nil), r.calls...)
+}
+
+// CallCount returns count of recorded calls.
+func (r *Recorder[T]) CallCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.calls)
+}
+
+// CalledWith reports whether function was called with provided arguments. Arguments must match original function
+// parameters like ones passed to Expectation.With (false returned otherwise), they compared with recorded
+// arguments using reflect.DeepEqual.
+func (r *Recorder[T]) CalledWith(args ...any) bool {
+	if r.funcType == nil {
+		return false
+	}
+
+	values, err := makeValues(r.funcType.In, r.funcType.NumIn(), args)
+	if err != nil {
+		return false
+	}
+
+	args = interfaces(values)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, call := range r.calls {
+		if reflect.DeepEqual(call.Args, args) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reset removes recorded calls.
+func (r *Recorder[T]) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = nil
+}
+
+func (r *Recorder[T]) record(call Call[T]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, call)
+}
+
+// snapshot returns deep copies of values. Arguments may be placed on stack of caller because original function
+// doesn't retain them, so they must be copied to be stored after call. Functions and unsafe pointers
+// can't be copied, so they replaced by nil.
+func snapshot(values []reflect.Value) []any {
+	visited := map[visit]reflect.Value{}
+
+	ret := make([]any, len(values))
+	for i, value := range values {
+		ret[i] = deepCopy(value, visited).Interface()
+	}
+
+	return ret
+}
+
+// visit is a pointer copied by deepCopy, it's used to copy cyclic structures.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+func deepCopy(v reflect.Value, visited map[visit]reflect.Value) reflect.Value {
+	v = accessible(v)
+	ret := reflect.New(v.Type()).Elem()
+
+	switch v.Kind() {
+	case reflect.String:
+		ret.SetString(strings.Clone(v.String()))
+	case reflect.Pointer:
+		if v.IsNil() {
+			break
+		}
+
+		key := visit{ptr: v.Pointer(), typ: v.Type()}
+		if copied, ok := visited[key]; ok {
+			return copied
+		}
+
+		ret.Set(reflect.New(v.Type().Elem()))
+		visited[key] = ret
+		setUnexported(ret.Elem(), deepCopy(v.Elem(), visited))
+	case reflect.Slice:
+		if v.IsNil() {
+			break
+		}
+
+		ret.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			setUnexported(ret.Index(i), deepCopy(v.Index(i), visited))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			setUnexported(ret.Index(i), deepCopy(v.Index(i), visited))
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			break
+		}
+
+		ret.Set(reflect.MakeMapWithSize(v.Type(), v.Len()))
+		for iter := v.MapRange(); iter.Next(); {
+			ret.SetMapIndex(deepCopy(iter.Key(), visited), deepCopy(iter.Value(), visited))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			setUnexported(ret.Field(i), deepCopy(v.Field(i), visited))
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			ret.Set(deepCopy(v.Elem(), visited))
+		}
+	case reflect.Func, reflect.UnsafePointer:
+		// left nil
+	default:
+		ret.Set(v)
+	}
+
+	return ret
+}
+
+// accessible returns addressable value which may be read and set even if it's obtained using unexported struct field.
+// Values which are not addressable (map elements, interface contents) are never obtained from unexported fields
+// by deepCopy, so they just copied.
+func accessible(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+	}
+
+	ret := reflect.New(v.Type()).Elem()
+	ret.Set(v)
+
+	return ret
+}
+
+// setUnexported sets addressable value even if it's obtained using unexported struct field.
+func setUnexported(dst, src reflect.Value) {
+	accessible(dst).Set(src)
+}
+
+// goroutineID returns identifier of current goroutine parsed from stack trace header ("goroutine N [running]:").
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+
+	if idx := bytes.IndexByte(buf, ' '); idx >= 0 {
+		buf = buf[:idx]
+	}
+
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+
+	return id
+}
+
+// callerFrame returns frame of code which called replaced function. Frames of replacement are skipped.
+func callerFrame() runtime.Frame {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	for {
+		frame, more := frames.Next()
+		if !isReplacementFrame(frame) {
+			return frame
+		}
+
+		if !more {
+			return runtime.Frame{}
+		}
+	}
+}
+
+// isReplacementFrame reports whether stack frame belongs to replacement synthesized by this package.
+func isReplacementFrame(frame runtime.Frame) bool {
+	pkgPrefix := reflect.TypeOf((*Patcher)(nil)).Elem().PkgPath() + "."
+
+	return strings.HasPrefix(frame.Function, "reflect.") || strings.HasPrefix(frame.Function, pkgPrefix)
+}